@@ -0,0 +1,81 @@
+package gohttp
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// byteBucket is a token bucket over bytes, refilled at rate bytes per second with a burst of one second.
+type byteBucket struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+var hostBandwidth = make(map[string]*byteBucket)
+var hostBandwidthLock sync.RWMutex
+
+// SetHostBandwidth limits how fast response bodies from host are read, to bytesPerSec across all
+// requests to host, so a crawl doesn't saturate the uplink of a small site. It complements SetHostDelay,
+// which spaces the requests out but not their transfer. The limit applies to the body as it is read,
+// by Bytes, String, WriteTo or a caller reading the Body returned by End. A bytesPerSec <= 0 removes it.
+func SetHostBandwidth(host string, bytesPerSec int64) {
+	defer hostBandwidthLock.Unlock()
+	hostBandwidthLock.Lock()
+
+	if bytesPerSec <= 0 {
+		delete(hostBandwidth, host)
+		return
+	}
+	hostBandwidth[host] = &byteBucket{rate: bytesPerSec, tokens: float64(bytesPerSec), last: time.Now()}
+}
+
+// limitBody wraps body in a reader throttled to the bandwidth of host, body itself when host has no limit.
+func limitBody(host string, body io.ReadCloser) io.ReadCloser {
+	hostBandwidthLock.RLock()
+	bucket, ok := hostBandwidth[host]
+	hostBandwidthLock.RUnlock()
+	if !ok {
+		return body
+	}
+	return &limitReader{body, bucket}
+}
+
+// take spends n bytes and returns how long to wait for the bucket to be back in credit.
+func (b *byteBucket) take(n int) time.Duration {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+type limitReader struct {
+	io.ReadCloser
+	bucket *byteBucket
+}
+
+func (r *limitReader) Read(p []byte) (int, error) {
+	// never read more than a second worth of bytes at once
+	if int64(len(p)) > r.bucket.rate {
+		p = p[:r.bucket.rate]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if d := r.bucket.take(n); d > 0 {
+			time.Sleep(d)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,235 @@
+package gohttp
+
+import (
+	"container/list"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	key     string
+	body    []byte
+	code    int
+	expires time.Time
+	// vary holds the request headers named by the Vary header of the response, with their values
+	vary map[string]string
+}
+
+// responseCache is a LRU cache of decoded response bodies.
+type responseCache struct {
+	lock    sync.Mutex
+	max     int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+var defaultCache *responseCache
+var defaultCacheLock sync.RWMutex
+
+// EnableCache turns on an in-memory cache of GET responses holding up to maxEntries bodies.
+// Responses are cached according to their Cache-Control max-age or Expires header, and while
+// fresh Bytes, String, ToJSON and ToXML return the cached body without sending the request.
+// The cache is shared by all agents, so requests carrying credentials, an Authorization header or
+// cookies, are never cached, and a response only serves requests matching its Vary headers.
+// Use NoCache to bypass it for one request. A maxEntries <= 0 turns the cache off.
+func EnableCache(maxEntries int) {
+	defer defaultCacheLock.Unlock()
+	defaultCacheLock.Lock()
+
+	if maxEntries <= 0 {
+		defaultCache = nil
+		return
+	}
+	defaultCache = &responseCache{
+		max:     maxEntries,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func getCache() *responseCache {
+	defer defaultCacheLock.RUnlock()
+	defaultCacheLock.RLock()
+	return defaultCache
+}
+
+// get returns a copy of the fresh entry of key, if header gives the values its Vary headers were cached with.
+func (c *responseCache) get(key string, header func(string) string) (*cacheEntry, bool) {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	for name, value := range entry.vary {
+		if header(name) != value {
+			return nil, false
+		}
+	}
+	c.order.MoveToFront(elem)
+	copied := *entry
+	copied.body = append([]byte(nil), entry.body...)
+	return &copied, true
+}
+
+func (c *responseCache) put(key string, code int, body []byte, expires time.Time, vary map[string]string) {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+
+	body = append([]byte(nil), body...)
+	entry := &cacheEntry{key: key, body: body, code: code, expires: expires, vary: vary}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.max {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.entries, last.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheExpires returns until when a response may be cached, false if it may not.
+func cacheExpires(header http.Header) (time.Time, bool) {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "no-cache":
+			return time.Time{}, false
+		case strings.HasPrefix(directive, "max-age="):
+			age, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil || age <= 0 {
+				return time.Time{}, false
+			}
+			return time.Now().Add(time.Duration(age) * time.Second), true
+		}
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil || !t.After(time.Now()) {
+			return time.Time{}, false
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// NoCache bypasses the response cache for the current request, its response isn't cached either.
+func (s *HttpAgent) NoCache() *HttpAgent {
+	s.startRequest()
+	s.noCache = true
+	return s
+}
+
+// Cached reports whether the body of the last Bytes, String, ToJSON or ToXML call came from the cache.
+func (s *HttpAgent) Cached() bool {
+	return s.cached
+}
+
+// cacheVary returns the request headers named by the Vary header of resp, false when it varies on everything.
+func cacheVary(resp *http.Response) (map[string]string, bool) {
+	vary := make(map[string]string)
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				vary[name] = resp.Request.Header.Get(name)
+			}
+		}
+	}
+	return vary, true
+}
+
+// cacheHeader returns the value of the request header name as End would send it.
+func (s *HttpAgent) cacheHeader(name string) string {
+	name = http.CanonicalHeaderKey(name)
+	for _, h := range []map[string]string{s.requestHeader, s.Header} {
+		for k, v := range h {
+			if http.CanonicalHeaderKey(k) == name {
+				return v
+			}
+		}
+	}
+	for k, v := range GetDefaultHeaders() {
+		if http.CanonicalHeaderKey(k) == name {
+			return v
+		}
+	}
+	if name == "User-Agent" {
+		return s.option().Agent
+	}
+	return ""
+}
+
+// hasCredentials reports whether the request to uri carries an Authorization header or cookies,
+// its response is then private to the agent. A jar that can't be looked into counts as having cookies.
+func (s *HttpAgent) hasCredentials(uri *url.URL) bool {
+	if s.TokenFn != nil || s.cacheHeader("Authorization") != "" || s.cacheHeader("Cookie") != "" {
+		return true
+	}
+	if s.noCookies {
+		return false
+	}
+	if len(s.Cookies) > 0 {
+		return true
+	}
+	if !s.Usejar {
+		return false
+	}
+	var jar http.CookieJar
+	switch {
+	case s.CookieJar != nil:
+		jar = s.CookieJar
+	case s.Client != nil:
+		jar = s.Client.Jar
+	default:
+		getter := GetDefaultGetter()
+		if s.Getter != nil {
+			getter = s.Getter
+		} else if s.optionGetter != nil {
+			getter = s.optionGetter
+		}
+		roll, ok := getter.(*IpRollClient)
+		return !ok || roll.hasCookies(uri)
+	}
+	return jar != nil && len(jar.Cookies(uri)) > 0
+}
+
+// cacheKey returns the key of the current request in the response cache, "" if it can't be cached.
+func (s *HttpAgent) cacheKey() string {
+	if s.noCache || s.Method != GET {
+		return ""
+	}
+	uri, err := url.Parse(s.Url)
+	if err != nil || s.hasCredentials(uri) {
+		return ""
+	}
+	if s.rawQuery != "" {
+		uri.RawQuery = s.rawQuery
+	} else if len(s.QueryData) > 0 {
+		q := uri.Query()
+		for k, v := range s.QueryData {
+			for _, vv := range v {
+				q.Add(k, vv)
+			}
+		}
+		uri.RawQuery = q.Encode()
+	}
+	return s.Method + " " + uri.String()
+}
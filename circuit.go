@@ -0,0 +1,112 @@
+package gohttp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitOpenError is returned by End when the circuit breaker of the host is open,
+// the request is not sent at all.
+type CircuitOpenError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for host %s until %s", e.Host, e.Until.Format(time.RFC3339))
+}
+
+type hostCircuit struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	failures  int
+	first     time.Time
+	openUntil time.Time
+	probing   bool
+}
+
+var hostCircuits = make(map[string]*hostCircuit)
+var hostCircuitLock sync.Mutex
+
+// SetHostCircuit enables a circuit breaker for host. After threshold consecutive failures
+// (transport errors or 5xx responses) within window, requests to host fail fast with a *CircuitOpenError
+// for cooldown, without waiting for the host delay. Failures further apart than window start the count again,
+// a window <= 0 counts them however far apart. Once cooldown has passed a single probe request is let through,
+// its success closes the circuit again and its failure opens it for another cooldown.
+// A threshold <= 0 removes the circuit breaker.
+func SetHostCircuit(host string, threshold int, window, cooldown time.Duration) {
+	defer hostCircuitLock.Unlock()
+	hostCircuitLock.Lock()
+
+	if threshold <= 0 {
+		delete(hostCircuits, host)
+		return
+	}
+	hostCircuits[host] = &hostCircuit{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+	}
+}
+
+// circuitOpen returns a *CircuitOpenError when the circuit of host is open, without claiming
+// the probe of a half open circuit, so End can fail fast before getting a client.
+func circuitOpen(host string) error {
+	defer hostCircuitLock.Unlock()
+	hostCircuitLock.Lock()
+
+	c, ok := hostCircuits[host]
+	if !ok || c.failures < c.threshold {
+		return nil
+	}
+	if time.Now().Before(c.openUntil) || c.probing {
+		return &CircuitOpenError{Host: host, Until: c.openUntil}
+	}
+	return nil
+}
+
+// allowHost reports whether a request to host may be sent.
+func allowHost(host string) error {
+	defer hostCircuitLock.Unlock()
+	hostCircuitLock.Lock()
+
+	c, ok := hostCircuits[host]
+	if !ok || c.failures < c.threshold {
+		return nil
+	}
+	if time.Now().Before(c.openUntil) || c.probing {
+		return &CircuitOpenError{Host: host, Until: c.openUntil}
+	}
+	// half open, let one probe through
+	c.probing = true
+	return nil
+}
+
+// reportHost records the outcome of a request to host.
+func reportHost(host string, success bool) {
+	defer hostCircuitLock.Unlock()
+	hostCircuitLock.Lock()
+
+	c, ok := hostCircuits[host]
+	if !ok {
+		return
+	}
+	c.probing = false
+	if success {
+		c.failures = 0
+		return
+	}
+	now := time.Now()
+	if c.failures > 0 && c.failures < c.threshold && c.window > 0 && now.Sub(c.first) > c.window {
+		c.failures = 0
+	}
+	if c.failures == 0 {
+		c.first = now
+	}
+	c.failures++
+	if c.failures >= c.threshold {
+		c.openUntil = now.Add(c.cooldown)
+	}
+}
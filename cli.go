@@ -1,13 +1,24 @@
 package gohttp
 
 import (
+	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"sync"
 	"time"
 )
 
+// ClientGetter hands End the client each request is sent with. It is where clients come from:
+// the default one, IpRollClient, rotates the local ip of Option.Address and applies the host delays,
+// a getter of your own can draw clients from a pool or ask a proxy rotation service.
+// Register it for every agent with SetDefaultGetter, or for one agent with WithGetter.
+//
+// GetHttpClient is called once per request, from concurrent goroutines, with the url of the request,
+// the proxy set with Proxy ("" for none) and whether the cookie jar is used (see Jar). End sets
+// CheckRedirect, Timeout and possibly Jar and Transport on the client returned, so return a client
+// of its own for each call. Sharing the transport is fine, End never modifies it.
 type ClientGetter interface {
 	GetHttpClient(httpurl string, proxyurl string, usejar bool) (*http.Client, error)
 }
@@ -16,8 +27,11 @@ type IpRollClient struct {
 	ips        []string
 	useLock    sync.RWMutex
 	useMap     map[string]*useInfo
+	useCount   map[string]int64
 	clientMap  map[string]*clientResource
 	clientLock sync.RWMutex
+	// option replaces the default options when set, see optionClient
+	option *Option
 }
 
 func NewIpRollClient(ip ...string) *IpRollClient {
@@ -26,8 +40,9 @@ func NewIpRollClient(ip ...string) *IpRollClient {
 	}
 
 	roll := &IpRollClient{
-		ips:    ip,
-		useMap: make(map[string]*useInfo),
+		ips:      ip,
+		useMap:   make(map[string]*useInfo),
+		useCount: make(map[string]int64),
 	}
 
 	if len(ip) > 0 {
@@ -37,6 +52,73 @@ func NewIpRollClient(ip ...string) *IpRollClient {
 	return roll
 }
 
+// maxOptionClients bounds the getters kept for WithOption, the least recently used one is dropped past it
+const maxOptionClients = 64
+
+var optionClients = make(map[string]*IpRollClient)
+var optionClientKeys []string
+var optionClientsLock sync.Mutex
+
+// optionClient returns a getter whose clients follow option instead of the default options:
+// it rotates over option.Address, waits option.Delay and builds transports of its own.
+// Agents with the same options share it, so they share the delays and the connections.
+// Agents keep the getter they got when it is dropped from the shared ones, they just stop sharing it.
+func optionClient(option Option) *IpRollClient {
+	optionClientsLock.Lock()
+
+	key := fmt.Sprintf("%#v", option)
+	for i, k := range optionClientKeys {
+		if k == key {
+			optionClientKeys = append(optionClientKeys[:i], optionClientKeys[i+1:]...)
+			optionClientKeys = append(optionClientKeys, key)
+			break
+		}
+	}
+	if roll, ok := optionClients[key]; ok {
+		optionClientsLock.Unlock()
+		return roll
+	}
+
+	roll := NewIpRollClient(option.Address...)
+	roll.option = &option
+	roll.clientMap = make(map[string]*clientResource)
+	optionClients[key] = roll
+	optionClientKeys = append(optionClientKeys, key)
+
+	var dropped *IpRollClient
+	if len(optionClientKeys) > maxOptionClients {
+		dropped = optionClients[optionClientKeys[0]]
+		delete(optionClients, optionClientKeys[0])
+		optionClientKeys = optionClientKeys[1:]
+	}
+	optionClientsLock.Unlock()
+
+	if dropped != nil {
+		dropped.closeIdleConnections()
+	}
+	return roll
+}
+
+// getOptionClients returns the getters shared by WithOption agents.
+func getOptionClients() []*IpRollClient {
+	defer optionClientsLock.Unlock()
+	optionClientsLock.Lock()
+
+	rolls := make([]*IpRollClient, 0, len(optionClients))
+	for _, roll := range optionClients {
+		rolls = append(rolls, roll)
+	}
+	return rolls
+}
+
+// getOption returns the options of the getter.
+func (s *IpRollClient) getOption() Option {
+	if s.option != nil {
+		return *s.option
+	}
+	return GetOption()
+}
+
 func (s *IpRollClient) GetHttpClient(urlStr string, proxy string, usejar bool) (*http.Client, error) {
 
 	var clientres *clientResource
@@ -45,11 +127,12 @@ func (s *IpRollClient) GetHttpClient(urlStr string, proxy string, usejar bool) (
 		if err != nil {
 			return nil, err
 		}
+		option := s.getOption()
 		proxyTransport := &http.Transport{
-			Dial:                defaultDialer.Dial,
+			DialContext:         GetDefaultDialer().DialContext,
 			Proxy:               http.ProxyURL(proxyuri),
-			MaxIdleConnsPerHost: defaultOption.MaxIdleConns,
-			TLSHandshakeTimeout: defaultOption.TLSTimeout,
+			MaxIdleConnsPerHost: option.MaxIdleConns,
+			TLSHandshakeTimeout: option.TLSTimeout,
 			DisableKeepAlives:   true,
 		}
 		if IsDebug() {
@@ -67,29 +150,33 @@ func (s *IpRollClient) GetHttpClient(urlStr string, proxy string, usejar bool) (
 		//并发取的时候锁定
 		s.useLock.Lock()
 		use, ok := s.useMap[uri.Host]
-		need_delay := GetHostDelay(uri.Host)
+		option := s.getOption()
+		need_delay := jitterDelay(hostDelayOr(uri.Host, option.Delay), option.DelayJitter)
 		if ok {
-			//need_delay
-			lastIndex := use.Index
 			if len(s.ips) != 0 {
 				use.Index = (use.Index + 1) % len(s.ips)
 			}
-
-			//使用同一个IP，则需要延迟
-			if lastIndex == use.Index && need_delay > 0 {
-				sub := time.Now().Sub(use.LastTime)
-				if sub < need_delay {
-					delay = need_delay - sub
-				}
-			}
-			use.LastTime = time.Now().Add(delay)
 		} else {
 			use = &useInfo{
 				Index:    0,
-				LastTime: time.Now(),
+				LastTime: make(map[int]time.Time),
 			}
 		}
+
+		//同一个IP再次使用，则需要延迟
+		if last, ok := use.LastTime[use.Index]; ok && need_delay > 0 {
+			sub := time.Now().Sub(last)
+			if sub < need_delay {
+				delay = need_delay - sub
+			}
+		}
+		use.LastTime[use.Index] = time.Now().Add(delay)
 		s.useMap[uri.Host] = use
+		if len(s.ips) == 0 {
+			s.useCount["0.0.0.0"]++
+		} else {
+			s.useCount[s.ips[use.Index]]++
+		}
 		s.useLock.Unlock()
 
 		if IsDebug() {
@@ -104,17 +191,30 @@ func (s *IpRollClient) GetHttpClient(urlStr string, proxy string, usejar bool) (
 			time.Sleep(delay)
 		}
 
-		if len(s.ips) == 0 {
-			clientres = &clientResource{defaultTransport, defaultCookiejar}
+		if len(s.ips) == 0 && s.option == nil {
+			clientres = &clientResource{GetDefaultTransport(), defaultCookiejar}
 		} else {
 			//
 			//加锁并发
-			ip := s.ips[use.Index]
+			ip, jar := "0.0.0.0", defaultCookiejar
+			if len(s.ips) != 0 {
+				ip = s.ips[use.Index]
+			}
 			s.clientLock.Lock()
 			if v, ok := s.clientMap[ip]; ok {
 				clientres = v
 			} else {
-				clientres = &clientResource{MakeTransport(ip), MakeCookiejar()}
+				optionLock.RLock()
+				transport, err := makeTransportOption(ip, &option)
+				optionLock.RUnlock()
+				if err != nil {
+					s.clientLock.Unlock()
+					return nil, fmt.Errorf("bind local address %s: %v", ip, err)
+				}
+				if len(s.ips) != 0 {
+					jar = MakeCookiejar()
+				}
+				clientres = &clientResource{transport, jar}
 				s.clientMap[ip] = clientres
 			}
 			s.clientLock.Unlock()
@@ -124,9 +224,73 @@ func (s *IpRollClient) GetHttpClient(urlStr string, proxy string, usejar bool) (
 	if usejar {
 		return MakeClient(clientres.Transport, clientres.Jar), nil
 	}
+	// without the jar, cookies live as long as the request and its redirects
 	return MakeClient(clientres.Transport, MakeCookiejar()), nil
 }
 
+// rebuildTransports replaces the per ip transports by new ones built from the current settings, after SetDialer
+// and the like. The cookie jars, the rotation and the delays are kept. The caller must not hold optionLock.
+func (s *IpRollClient) rebuildTransports() {
+	s.clientLock.Lock()
+	defer s.clientLock.Unlock()
+	optionLock.RLock()
+	defer optionLock.RUnlock()
+
+	option := defaultOption
+	if s.option != nil {
+		option = s.option
+	}
+	for ip, res := range s.clientMap {
+		transport, err := makeTransportOption(ip, option)
+		if err != nil {
+			continue
+		}
+		if old, ok := res.Transport.(*http.Transport); ok {
+			old.CloseIdleConnections()
+		}
+		s.clientMap[ip] = &clientResource{transport, res.Jar}
+	}
+}
+
+// closeIdleConnections closes the idle connections of the transports of the getter.
+func (s *IpRollClient) closeIdleConnections() {
+	s.clientLock.Lock()
+	defer s.clientLock.Unlock()
+
+	for _, res := range s.clientMap {
+		if transport, ok := res.Transport.(*http.Transport); ok {
+			transport.CloseIdleConnections()
+		}
+	}
+}
+
+// hasCookies reports whether any jar of the getter holds cookies for uri.
+func (s *IpRollClient) hasCookies(uri *url.URL) bool {
+	if len(defaultCookiejar.Cookies(uri)) > 0 {
+		return true
+	}
+	s.clientLock.RLock()
+	defer s.clientLock.RUnlock()
+	for _, client := range s.clientMap {
+		if client.Jar != nil && len(client.Jar.Cookies(uri)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// jitterDelay moves delay at random by up to jitter, a fraction of it, never below zero.
+func jitterDelay(delay time.Duration, jitter float64) time.Duration {
+	if delay <= 0 || jitter <= 0 {
+		return delay
+	}
+	d := float64(delay) + float64(delay)*jitter*(2*rand.Float64()-1)
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(d)
+}
+
 func (s *IpRollClient) ResetCookie(uri *url.URL) {
 	s.clientLock.Lock()
 	for _, client := range s.clientMap {
@@ -141,3 +305,31 @@ func (s *IpRollClient) ResetCookie(uri *url.URL) {
 	}
 	s.clientLock.Unlock()
 }
+
+// ClientStats is a snapshot of how requests were distributed by the client getter.
+type ClientStats struct {
+	// IPRequests counts requests per local ip address, "0.0.0.0" when no Option.Address is set.
+	IPRequests map[string]int64
+	// Clients is the number of per ip transports built so far.
+	Clients int
+	// HostDelay is the delay configured per host with SetHostDelay.
+	HostDelay map[string]time.Duration
+}
+
+// Stats returns a snapshot of the ip rotation of this client.
+func (s *IpRollClient) Stats() ClientStats {
+	s.useLock.RLock()
+	s.clientLock.RLock()
+	defer s.useLock.RUnlock()
+	defer s.clientLock.RUnlock()
+
+	stats := ClientStats{
+		IPRequests: make(map[string]int64, len(s.useCount)),
+		Clients:    len(s.clientMap),
+		HostDelay:  getHostDelays(),
+	}
+	for ip, count := range s.useCount {
+		stats.IPRequests[ip] = count
+	}
+	return stats
+}
@@ -1,10 +1,12 @@
 package gohttp
 
 import (
+	"crypto/tls"
 	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,6 +24,14 @@ type Option struct {
 	MaxIdleConns    int
 	MaxConnsPerHost int
 	Http2           bool
+	ArrayFormat     string
+	IgnoreEnvProxy  bool
+	// DelayJitter moves the delay between requests to a host at random by up to this fraction of it,
+	// 0.3 turns a 1s delay into anything from 0.7s to 1.3s, so the timing looks less regular
+	DelayJitter float64
+	// TLSSessionCache is the number of TLS sessions kept to resume handshakes. Resumption is off by
+	// default, a negative value turns it back off in SetOption, where 0 leaves it unchanged.
+	TLSSessionCache int
 }
 
 type clientResource struct {
@@ -30,31 +40,48 @@ type clientResource struct {
 }
 
 type useInfo struct {
-	Index    int
-	LastTime time.Time
+	Index int
+	// last request time per ip index
+	LastTime map[int]time.Time
 }
 
 var defaultOption = &Option{
 	ConnectTimeout: 30000 * time.Millisecond,
 	TLSTimeout:     30 * time.Second,
+	Timeout:        60 * time.Second,
 	Agent:          "gohttp v1.0",
 	Address:        make([]string, 0),
 	MaxRedirects:   -1,
 	MaxIdleConns:   0,
 	Http2:          false,
+	ArrayFormat:    ArrayBrackets,
 }
 
 var debug = false
+
+// optionLock guards defaultOption and everything built from it below
+var optionLock sync.RWMutex
+var customDialer *net.Dialer
+var proxyFunc func(*http.Request) (*url.URL, error)
+var sessionCache tls.ClientSessionCache
 var defaultDialer = &net.Dialer{Timeout: defaultOption.ConnectTimeout}
-var defaultTransport = MakeTransport("0.0.0.0")
+var defaultTransport, _ = makeTransport("0.0.0.0")
 var defaultCookiejar = MakeCookiejar()
 
 // var proxyTransport *http.Transport
 
+var defaultHeaders = make(map[string]string)
+var defaultHeadersLock sync.RWMutex
+
 var hostDelay = make(map[string]time.Duration)
 var hostDelayLock sync.RWMutex
 
+var serialPerHost bool
+var hostLocks = make(map[string]*sync.Mutex)
+var hostLocksLock sync.Mutex
+
 var defaultGetter = NewIpRollClient(defaultOption.Address...)
+var customGetter ClientGetter
 
 func MakeCookiejar() http.CookieJar {
 	cookiejarOptions := cookiejar.Options{
@@ -69,32 +96,79 @@ func MakeClient(transport http.RoundTripper, jar http.CookieJar) *http.Client {
 	return &http.Client{Jar: jar, Transport: transport}
 }
 
-func MakeTransport(ip string) *http.Transport {
-	addr, _ := net.ResolveTCPAddr("tcp", ip+":0")
-	dialer := &net.Dialer{
-		Timeout:   defaultOption.ConnectTimeout,
-		LocalAddr: addr,
+// makeDialer builds a dialer from the one set by SetDialer, binding it to the given local address.
+// The caller holds optionLock.
+func makeDialer(addr *net.TCPAddr, option *Option) *net.Dialer {
+	dialer := &net.Dialer{}
+	if customDialer != nil {
+		*dialer = *customDialer
+	}
+	if dialer.Timeout == 0 {
+		dialer.Timeout = option.ConnectTimeout
+	}
+	if addr != nil && (dialer.LocalAddr == nil || !addr.IP.IsUnspecified()) {
+		dialer.LocalAddr = addr
+	}
+	return dialer
+}
+
+// transportProxy returns the proxy function transports are built with.
+// The caller holds optionLock.
+func transportProxy(option *Option) func(*http.Request) (*url.URL, error) {
+	if proxyFunc != nil {
+		return proxyFunc
+	}
+	if option.IgnoreEnvProxy {
+		return nil
 	}
+	return http.ProxyFromEnvironment
+}
+
+// MakeTransport builds a transport whose connections are bound to the local ip, IPv4 or IPv6.
+// An ip that can't be resolved is ignored, use makeTransport to get the error.
+func MakeTransport(ip string) *http.Transport {
+	defer optionLock.RUnlock()
+	optionLock.RLock()
+
+	transport, _ := makeTransport(ip)
+	return transport
+}
+
+// makeTransport is MakeTransport returning the error, the caller holds optionLock.
+func makeTransport(ip string) (*http.Transport, error) {
+	return makeTransportOption(ip, defaultOption)
+}
+
+// makeTransportOption is makeTransport with the settings of option instead of the default ones,
+// the caller holds optionLock.
+func makeTransportOption(ip string, option *Option) (*http.Transport, error) {
+	ip = strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ip, "0"))
+	dialer := makeDialer(addr, option)
 	transport := &http.Transport{
-		Dial:                dialer.Dial,
-		Proxy:               http.ProxyFromEnvironment,
-		MaxIdleConnsPerHost: defaultOption.MaxIdleConns,
-		TLSHandshakeTimeout: defaultOption.TLSTimeout,
+		DialContext:         dialer.DialContext,
+		Proxy:               transportProxy(option),
+		MaxIdleConnsPerHost: option.MaxIdleConns,
+		TLSHandshakeTimeout: option.TLSTimeout,
 	}
 
-	if defaultOption.MaxIdleConns <= 0 {
+	if option.MaxIdleConns <= 0 {
 		transport.DisableKeepAlives = true
 	}
 
-	if defaultOption.MaxConnsPerHost > 0 {
-		transport.MaxConnsPerHost = defaultOption.MaxConnsPerHost
+	if option.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = option.MaxConnsPerHost
+	}
+
+	if option.Http2 {
+		transport.DialContext = nil
 	}
 
-	if defaultOption.Http2 {
-		transport.Dial = nil
+	if sessionCache != nil {
+		transport.TLSClientConfig = &tls.Config{ClientSessionCache: sessionCache}
 	}
 
-	return transport
+	return transport, err
 }
 
 func SetDebug(d bool) {
@@ -110,17 +184,92 @@ func IsDebug() bool {
 	return debug
 }
 
+// SetDefaultHeaders sets headers sent with every request, like Accept-Language or a tenant header.
+// Headers set on an agent with Set take precedence. It replaces the previous default headers.
+func SetDefaultHeaders(h map[string]string) {
+	defer defaultHeadersLock.Unlock()
+	defaultHeadersLock.Lock()
+
+	defaultHeaders = make(map[string]string, len(h))
+	for k, v := range h {
+		defaultHeaders[k] = v
+	}
+}
+
+// GetDefaultHeaders returns a copy of the headers set by SetDefaultHeaders.
+func GetDefaultHeaders() map[string]string {
+	defer defaultHeadersLock.RUnlock()
+	defaultHeadersLock.RLock()
+
+	h := make(map[string]string, len(defaultHeaders))
+	for k, v := range defaultHeaders {
+		h[k] = v
+	}
+	return h
+}
+
+// SetHostDelay sets the minimum time between two requests to host from the same ip, replacing
+// any delay set before for it, lower or higher. Hosts without one use Option.Delay.
 func SetHostDelay(host string, delay time.Duration) {
 	defer hostDelayLock.Unlock()
 	hostDelayLock.Lock()
-	if d, ok := hostDelay[host]; ok && delay > d {
-		hostDelay[host] = delay
-		return
-	}
 	hostDelay[host] = delay
 }
 
+// ClearHostDelay removes the delay set for host, which goes back to Option.Delay.
+func ClearHostDelay(host string) {
+	defer hostDelayLock.Unlock()
+	hostDelayLock.Lock()
+	delete(hostDelay, host)
+}
+
+// ClearAllDelays removes the delays of all hosts, for example between two phases of a crawl.
+func ClearAllDelays() {
+	defer hostDelayLock.Unlock()
+	hostDelayLock.Lock()
+	hostDelay = make(map[string]time.Duration)
+}
+
+// SerialPerHost makes requests to a same host run strictly one after the other, across goroutines,
+// each waiting for End of the previous one to return, its response received, before the host delay starts.
+// Reading the body is not covered, a body left open never blocks the host.
+// It keeps to rate limits at the cost of throughput: one slow response holds up every request to its host.
+func SerialPerHost(on bool) {
+	defer hostLocksLock.Unlock()
+	hostLocksLock.Lock()
+	serialPerHost = on
+}
+
+// lockHost locks the host of urlStr when SerialPerHost is on. It returns the function unlocking it,
+// or nil when there is nothing to lock.
+func lockHost(urlStr string) func() {
+	uri, err := url.Parse(urlStr)
+	if err != nil {
+		return nil
+	}
+
+	hostLocksLock.Lock()
+	if !serialPerHost {
+		hostLocksLock.Unlock()
+		return nil
+	}
+	lock, ok := hostLocks[uri.Host]
+	if !ok {
+		lock = &sync.Mutex{}
+		hostLocks[uri.Host] = lock
+	}
+	hostLocksLock.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
 func GetHostDelay(host string) time.Duration {
+	return hostDelayOr(host, GetOption().Delay)
+}
+
+// hostDelayOr returns the delay set for host with SetHostDelay, delay when there is none.
+func hostDelayOr(host string, delay time.Duration) time.Duration {
 	defer hostDelayLock.RUnlock()
 	hostDelayLock.RLock()
 
@@ -128,10 +277,90 @@ func GetHostDelay(host string) time.Duration {
 		return d
 	}
 
-	return defaultOption.Delay
+	return delay
 }
 
+func getHostDelays() map[string]time.Duration {
+	defer hostDelayLock.RUnlock()
+	hostDelayLock.RLock()
+
+	delays := make(map[string]time.Duration, len(hostDelay))
+	for host, d := range hostDelay {
+		delays[host] = d
+	}
+	return delays
+}
+
+// Stats returns a snapshot of the ip rotation of the default client getter, to check
+// that requests are spread evenly across Option.Address.
+func Stats() ClientStats {
+	if roll, ok := GetDefaultGetter().(*IpRollClient); ok {
+		return roll.Stats()
+	}
+	return ClientStats{
+		IPRequests: make(map[string]int64),
+		HostDelay:  getHostDelays(),
+	}
+}
+
+// mergeOption returns base with the fields of option set, those SetOption would change.
+func mergeOption(base Option, option *Option) Option {
+	if option.Agent != "" {
+		base.Agent = option.Agent
+	}
+	if option.ConnectTimeout > 0 {
+		base.ConnectTimeout = option.ConnectTimeout
+	}
+	if option.TLSTimeout > 0 {
+		base.TLSTimeout = option.TLSTimeout
+	}
+	if option.Timeout > 0 {
+		base.Timeout = option.Timeout
+	}
+	if option.Delay > 0 {
+		base.Delay = option.Delay
+	}
+	if option.DelayJitter > 0 {
+		base.DelayJitter = option.DelayJitter
+	}
+	if len(option.Address) > 0 {
+		base.Address = append([]string(nil), option.Address...)
+	}
+	if option.MaxRedirects > 0 {
+		base.MaxRedirects = option.MaxRedirects
+	}
+	if option.MaxIdleConns > 0 {
+		base.MaxIdleConns = option.MaxIdleConns
+	}
+	if option.MaxConnsPerHost > 0 {
+		base.MaxConnsPerHost = option.MaxConnsPerHost
+	}
+	if option.ArrayFormat != "" {
+		base.ArrayFormat = option.ArrayFormat
+	}
+	if option.IgnoreEnvProxy {
+		base.IgnoreEnvProxy = true
+	}
+	if option.Http2 {
+		base.Http2 = true
+	}
+	return base
+}
+
+// SetOption changes the default options. It is safe to call while requests are running:
+// when a field the transports are built from changes, the default transport is replaced by an
+// updated copy rather than modified in place, and the idle connections of the old one are closed.
 func SetOption(option *Option) {
+	optionLock.Lock()
+
+	var transport *http.Transport
+	clone := func() *http.Transport {
+		if transport == nil {
+			transport = defaultTransport.Clone()
+		}
+		return transport
+	}
+
 	if option.Agent != "" {
 		defaultOption.Agent = option.Agent
 	}
@@ -144,13 +373,23 @@ func SetOption(option *Option) {
 		defaultOption.TLSTimeout = option.TLSTimeout
 	}
 
+	if option.Timeout > 0 {
+		defaultOption.Timeout = option.Timeout
+	}
+
 	if option.Delay > 0 {
 		defaultOption.Delay = option.Delay
 	}
 
+	if option.DelayJitter > 0 {
+		defaultOption.DelayJitter = option.DelayJitter
+	}
+
+	var oldGetter *IpRollClient
 	if option.Address != nil && len(option.Address) > 0 {
 		defaultOption.Address = make([]string, 0)
 		defaultOption.Address = append(defaultOption.Address, option.Address...)
+		oldGetter = defaultGetter
 		defaultGetter = NewIpRollClient(defaultOption.Address...)
 	}
 
@@ -158,22 +397,101 @@ func SetOption(option *Option) {
 		defaultOption.MaxRedirects = option.MaxRedirects
 	}
 
-	if option.MaxIdleConns > 0 {
+	if option.MaxIdleConns > 0 && option.MaxIdleConns != defaultOption.MaxIdleConns {
 		defaultOption.MaxIdleConns = option.MaxIdleConns
-		defaultTransport.MaxIdleConnsPerHost = option.MaxIdleConns
+		clone().MaxIdleConnsPerHost = option.MaxIdleConns
 	}
 
-	if option.MaxConnsPerHost > 0 {
-		defaultOption.MaxConnsPerHost = option.MaxIdleConns
-		defaultTransport.MaxConnsPerHost = option.MaxConnsPerHost
+	if option.MaxConnsPerHost > 0 && option.MaxConnsPerHost != defaultOption.MaxConnsPerHost {
+		defaultOption.MaxConnsPerHost = option.MaxConnsPerHost
+		clone().MaxConnsPerHost = option.MaxConnsPerHost
 	}
 
-	if option.Http2 {
+	if option.ArrayFormat != "" {
+		defaultOption.ArrayFormat = option.ArrayFormat
+	}
+
+	if option.IgnoreEnvProxy && !defaultOption.IgnoreEnvProxy {
+		defaultOption.IgnoreEnvProxy = option.IgnoreEnvProxy
+		clone().Proxy = transportProxy(defaultOption)
+	}
+
+	if option.Http2 && !defaultOption.Http2 {
 		defaultOption.Http2 = option.Http2
-		defaultTransport.Dial = nil
+		clone().DialContext = nil
+	}
+
+	// one cache shared by all transports, sessions are looked up by server name
+	if option.TLSSessionCache != 0 && option.TLSSessionCache != defaultOption.TLSSessionCache {
+		sessionCache = nil
+		defaultOption.TLSSessionCache = 0
+		if option.TLSSessionCache > 0 {
+			defaultOption.TLSSessionCache = option.TLSSessionCache
+			sessionCache = tls.NewLRUClientSessionCache(option.TLSSessionCache)
+		}
+		config := &tls.Config{}
+		if clone().TLSClientConfig != nil {
+			config = transport.TLSClientConfig.Clone()
+		}
+		config.ClientSessionCache = sessionCache
+		transport.TLSClientConfig = config
+	}
+
+	if transport != nil {
+		replaceDefaultTransport(transport)
+	}
+	getter := defaultGetter
+	optionLock.Unlock()
+
+	if oldGetter != nil && oldGetter != getter {
+		oldGetter.closeIdleConnections()
+	}
+	if transport != nil {
+		getter.rebuildTransports()
 	}
 }
 
+// SetDialer sets the dialer all transports are built from, to control things like KeepAlive,
+// DualStack fallback or socket options through Control. The local address of each IP from
+// Option.Address is still bound on top of it, and Timeout defaults to Option.ConnectTimeout when zero.
+func SetDialer(d *net.Dialer) {
+	optionLock.Lock()
+	customDialer = d
+	defaultDialer = makeDialer(nil, defaultOption)
+	if !defaultOption.Http2 {
+		transport := defaultTransport.Clone()
+		transport.DialContext = makeDialer(nil, defaultOption).DialContext
+		replaceDefaultTransport(transport)
+	}
+	getter := defaultGetter
+	optionLock.Unlock()
+
+	getter.rebuildTransports()
+}
+
+// replaceDefaultTransport makes transport the default one, closing the idle connections of the previous one.
+// The caller holds optionLock.
+func replaceDefaultTransport(transport *http.Transport) {
+	old := defaultTransport
+	defaultTransport = transport
+	old.CloseIdleConnections()
+}
+
+// SetProxyFunc sets the function choosing the proxy of every request, for example to pick a proxy by host
+// or to rotate through a pool of proxies. It replaces HTTP_PROXY from the environment, a proxy set on an
+// agent with Proxy or ProxyFunc still wins. Passing nil goes back to the environment.
+func SetProxyFunc(fn func(*http.Request) (*url.URL, error)) {
+	optionLock.Lock()
+	proxyFunc = fn
+	transport := defaultTransport.Clone()
+	transport.Proxy = transportProxy(defaultOption)
+	replaceDefaultTransport(transport)
+	getter := defaultGetter
+	optionLock.Unlock()
+
+	getter.rebuildTransports()
+}
+
 func ResetCookie(urlstr string) error {
 	uri, err := url.Parse(urlstr)
 	if err != nil {
@@ -185,23 +503,60 @@ func ResetCookie(urlstr string) error {
 	}
 	defaultCookiejar.SetCookies(uri, cookies)
 
-	defaultGetter.ResetCookie(uri)
+	optionLock.RLock()
+	getter, custom := defaultGetter, customGetter
+	optionLock.RUnlock()
+	getter.ResetCookie(uri)
+	if r, ok := custom.(interface{ ResetCookie(*url.URL) }); ok {
+		r.ResetCookie(uri)
+	}
+	for _, roll := range getOptionClients() {
+		roll.ResetCookie(uri)
+	}
 
 	return nil
 }
 
+// GetOption returns a copy of the current default options.
+func GetOption() Option {
+	defer optionLock.RUnlock()
+	optionLock.RLock()
+	return *defaultOption
+}
+
 func GetDefaultDialer() *net.Dialer {
+	defer optionLock.RUnlock()
+	optionLock.RLock()
 	return defaultDialer
 }
 
 func GetDefaultTransport() *http.Transport {
+	defer optionLock.RUnlock()
+	optionLock.RLock()
 	return defaultTransport
 }
 
 func GetDefaultClient() *http.Client {
-	return MakeClient(defaultTransport, defaultCookiejar)
+	return MakeClient(GetDefaultTransport(), defaultCookiejar)
 }
 
+// GetDefaultGetter returns the client getter of agents without one of their own,
+// the one set with SetDefaultGetter or else the built-in *IpRollClient.
 func GetDefaultGetter() ClientGetter {
+	defer optionLock.RUnlock()
+	optionLock.RLock()
+	if customGetter != nil {
+		return customGetter
+	}
 	return defaultGetter
 }
+
+// SetDefaultGetter makes g the client getter of every agent without one of its own.
+// Option.Address, SetDialer, SetHostDelay and the like belong to the built-in getter and don't apply
+// to the clients of g. ResetCookie reaches g when it has a ResetCookie(*url.URL) method.
+// Passing nil goes back to the built-in getter.
+func SetDefaultGetter(g ClientGetter) {
+	defer optionLock.Unlock()
+	optionLock.Lock()
+	customGetter = g
+}
@@ -1,8 +1,12 @@
 package gohttp
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/json"
 	"encoding/xml"
@@ -10,17 +14,26 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
 )
 
 //type Request *http.Request
-//type Response *http.Response
 
 // HTTP methods we support
 const (
@@ -34,41 +47,94 @@ const (
 
 // A HttpAgent is a object storing all request data for client.
 type HttpAgent struct {
-	Url          string
-	ProxyUrl     string
-	Method       string
-	Header       map[string]string
-	TargetType   string
-	ForceType    string
-	Data         map[string]interface{}
-	FormData     url.Values
-	QueryData    url.Values
-	FileData     []File
-	Cookies      []*http.Cookie
-	TlsConfig    *tls.Config
-	MaxTimeout   time.Duration
-	MaxRedirects int
-	Client       *http.Client
-	SingleClient bool
-	Usejar       bool
-	Errors       []error
-	DataAll      interface{}
-	Getter       ClientGetter
+	Url             string
+	ProxyUrl        string
+	Method          string
+	Header          map[string]string
+	TargetType      string
+	ForceType       string
+	Data            map[string]interface{}
+	FormData        url.Values
+	QueryData       url.Values
+	FileData        []File
+	Cookies         []*http.Cookie
+	TlsConfig       *tls.Config
+	MaxTimeout      time.Duration
+	MaxRedirects    int
+	Client          *http.Client
+	SingleClient    bool
+	Usejar          bool
+	Errors          []error
+	DataAll         interface{}
+	Getter          ClientGetter
+	ArrayStyle      string
+	CookieJar       http.CookieJar
+	IgnoreEnvProxy  bool
+	ResolveMap      map[string]string
+	Context         context.Context
+	ContentType     string
+	Body            io.Reader
+	MaxTotalTimeout time.Duration
+	RawResponse     bool
+	KeepAliveConns  int
+	ProxyFn         func(*http.Request) (*url.URL, error)
+	Retry           *RetryPolicy
+	ContentCharset  string
+	BodyLength      int64
+	TransportFn     func(*http.Transport)
+	BodyEncoding    string
+	DialNetwork     string
+	ContinueTimeout time.Duration
+	IdleTimeout     time.Duration
+	HeaderTimeout   time.Duration
+	AutoAcceptType  bool
+	SameHostOnly    bool
+	ErrorBody       bool
+	Boundary        string
+	CloseConn       bool
+	QueryOrdered    bool
+	RedirectFn      func(req *http.Request, via []*http.Request) error
+	AgentOption     *Option
+	TokenFn         func(refresh bool) (string, error)
+
+	// headers set by helpers like Range, only sent with the current request
+	requestHeader map[string]string
+	requestID     string
+	noCache       bool
+	noCookies     bool
+	sent          bool
+	streaming     bool
+	deadline      time.Time
+	typedFields   []typedField
+	openFiles     []*os.File
+	queryKeys     []string
+	rawQuery      string
+	optionGetter  ClientGetter
+	cached        bool
+	finalURL      string
+	transports    map[*http.Transport]*http.Transport
+	transportTLS  *tls.Config
+	serverName    string
+	cancel        context.CancelFunc
+	cancelLock    sync.Mutex
+	transportLock sync.Mutex
 }
 
 // Used to create a new HttpAgent object.
 func New() *HttpAgent {
 	s := &HttpAgent{
-		TargetType:   "json",
-		Data:         make(map[string]interface{}),
-		Header:       make(map[string]string),
-		FormData:     url.Values{},
-		QueryData:    url.Values{},
-		FileData:     make([]File, 0),
-		Cookies:      make([]*http.Cookie, 0),
-		MaxRedirects: -1,
-		Errors:       nil,
-		Usejar:       true,
+		TargetType:     "json",
+		Data:           make(map[string]interface{}),
+		Header:         make(map[string]string),
+		requestHeader:  make(map[string]string),
+		FormData:       url.Values{},
+		QueryData:      url.Values{},
+		FileData:       make([]File, 0),
+		Cookies:        make([]*http.Cookie, 0),
+		MaxRedirects:   -1,
+		Errors:         nil,
+		Usejar:         true,
+		ContentCharset: "UTF-8",
 	}
 	return s
 }
@@ -76,37 +142,100 @@ func New() *HttpAgent {
 func NewSingle() *HttpAgent {
 
 	s := &HttpAgent{
-		TargetType:   "json",
-		Data:         make(map[string]interface{}),
-		Header:       make(map[string]string),
-		FormData:     url.Values{},
-		QueryData:    url.Values{},
-		FileData:     make([]File, 0),
-		Cookies:      make([]*http.Cookie, 0),
-		MaxRedirects: -1,
-		SingleClient: true,
-		Errors:       nil,
-		Usejar:       true,
+		TargetType:     "json",
+		Data:           make(map[string]interface{}),
+		Header:         make(map[string]string),
+		requestHeader:  make(map[string]string),
+		FormData:       url.Values{},
+		QueryData:      url.Values{},
+		FileData:       make([]File, 0),
+		Cookies:        make([]*http.Cookie, 0),
+		MaxRedirects:   -1,
+		SingleClient:   true,
+		Errors:         nil,
+		Usejar:         true,
+		ContentCharset: "UTF-8",
 	}
 	return s
 }
 
 // Clear HttpAgent data for another new request.
+// Only the per request data is cleared: method, url, body, query, files, type and errors.
+// Headers and cookies belong to the agent and are kept, so they can be set before the verb
+// and are sent with every following request of the agent:
+//
+//      req := gohttp.New().Set("Authorization", "Bearer xxx")
+//      req.Get("http://example.com/a").End() // sends Authorization
+//      req.Get("http://example.com/b").End() // sends Authorization too
+//
+// Settings for a single request, like Range, IfNoneMatch, IdempotencyKey, RequestID, NoCache, NoCookies
+// or Deadline, are dropped once the request is sent, those made before the verb apply to its request.
 func (s *HttpAgent) ClearAgent() {
 	s.Url = ""
 	s.Method = ""
-	s.Header = make(map[string]string)
+	s.startRequest()
+	s.cached = false
+	s.finalURL = ""
+	s.clearBody()
+	s.QueryData = url.Values{}
+	s.queryKeys = nil
+	s.rawQuery = ""
+	s.Errors = nil
+}
+
+// clearBody drops the body of the request and its type.
+func (s *HttpAgent) clearBody() {
 	s.Data = make(map[string]interface{})
 	s.FormData = url.Values{}
-	s.QueryData = url.Values{}
+	s.typedFields = nil
 	s.FileData = make([]File, 0)
+	s.closeFiles()
 	s.ForceType = ""
+	s.ContentType = ""
+	s.Body = nil
+	s.BodyLength = 0
+	s.BodyEncoding = ""
 	s.TargetType = "json"
-	s.Cookies = make([]*http.Cookie, 0)
-	s.Errors = nil
 	s.DataAll = nil
 }
 
+// startRequest drops the settings for a single request once the previous request was sent.
+func (s *HttpAgent) startRequest() {
+	if !s.sent {
+		return
+	}
+	s.sent = false
+	s.requestHeader = make(map[string]string)
+	s.requestID = ""
+	s.noCache = false
+	s.noCookies = false
+	s.deadline = time.Time{}
+}
+
+// setRequestHeader sets a header sent with the current request only.
+func (s *HttpAgent) setRequestHeader(key, value string) {
+	s.startRequest()
+	if s.requestHeader == nil {
+		s.requestHeader = make(map[string]string)
+	}
+	s.requestHeader[key] = value
+}
+
+// ClearErrors drops the errors collected so far in the chain, so End sends the request anyway.
+// Errors from builder methods like Type, Query, Send, SendFile or ClientCert are recoverable this way:
+// the failing call had no effect and the rest of the request is still valid.
+//
+//      gohttp.New().
+//        Get("/search").
+//        Query(optionalFilter). // may be malformed
+//        ClearErrors().
+//        End()
+//
+func (s *HttpAgent) ClearErrors() *HttpAgent {
+	s.Errors = nil
+	return s
+}
+
 func (s *HttpAgent) Get(targetUrl string) *HttpAgent {
 	s.ClearAgent()
 	s.Method = GET
@@ -162,17 +291,141 @@ func (s *HttpAgent) Patch(targetUrl string) *HttpAgent {
 //      Post("/gamelist").
 //      Set("Accept", "application/json").
 //      End()
+//
+// A Content-Type set here replaces the one End derives from the body type, except for multipart
+// bodies, which always keep their boundary: Set("Content-Type", "multipart/mixed") sends
+// multipart/mixed with the body's boundary, a non multipart type is ignored.
 func (s *HttpAgent) Set(param string, value string) *HttpAgent {
 	s.Header[param] = value
 	return s
 }
 
+// Host sends the request with h as Host header, whatever the host of the url. Over https, h is also
+// the server name of the TLS handshake (SNI) and the name the certificate is checked against.
+// Together with Resolve it reaches one backend by ip while presenting the public name:
+//
+//      gohttp.New().
+//        Get("https://10.0.0.12/health").
+//        Host("api.example.com").
+//        End()
+//
+// Set("Host", h) only changes the header. The server name goes on the agent's transport,
+// the TLS config set with TLSClientConfig is left as is.
+func (s *HttpAgent) Host(h string) *HttpAgent {
+	if s.Header == nil {
+		s.Header = make(map[string]string)
+	}
+	s.Header["Host"] = h
+	name := h
+	if host, _, err := net.SplitHostPort(h); err == nil {
+		name = host
+	}
+	s.serverName = strings.Trim(name, "[]")
+	s.resetTransports()
+	return s
+}
+
+// Range requests only part of the resource, from byte start to byte end inclusive.
+// A negative end requests everything from start on, which is handy for resuming a download:
+//
+//      f, _ := os.OpenFile("big.iso", os.O_APPEND|os.O_WRONLY, 0644)
+//      stat, _ := f.Stat()
+//      body, _, err := gohttp.New().
+//        Get("http://example.com/big.iso").
+//        Range(stat.Size(), -1).
+//        Bytes(http.StatusOK)
+//
+// Bytes and String accept 206 Partial Content as success whenever a Range is set.
+func (s *HttpAgent) Range(start, end int64) *HttpAgent {
+	if end < 0 {
+		s.setRequestHeader("Range", fmt.Sprintf("bytes=%d-", start))
+	} else {
+		s.setRequestHeader("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	}
+	return s
+}
+
+// IfNoneMatch makes the request conditional on the ETag of a cached copy.
+// When the resource is unchanged, Bytes and String return an empty body with code 304 and no error:
+//
+//      body, code, err := gohttp.New().
+//        Get("http://example.com/feed").
+//        IfNoneMatch(etag).
+//        Bytes(http.StatusOK)
+//      if err == nil && code == http.StatusNotModified {
+//        // use the cached copy
+//      }
+//
+func (s *HttpAgent) IfNoneMatch(etag string) *HttpAgent {
+	s.setRequestHeader("If-None-Match", etag)
+	return s
+}
+
+// IfModifiedSince makes the request conditional on the modification time of a cached copy.
+// A 304 Not Modified is handled like with IfNoneMatch.
+func (s *HttpAgent) IfModifiedSince(t time.Time) *HttpAgent {
+	s.setRequestHeader("If-Modified-Since", t.UTC().Format(http.TimeFormat))
+	return s
+}
+
+func (s *HttpAgent) isConditional() bool {
+	_, etag := s.requestHeader["If-None-Match"]
+	_, since := s.requestHeader["If-Modified-Since"]
+	return etag || since
+}
+
+// IdempotencyKey sets the Idempotency-Key header, so an API can recognize retries of the same logical request.
+// The key stays the same for every attempt of the request.
+func (s *HttpAgent) IdempotencyKey(key string) *HttpAgent {
+	s.setRequestHeader("Idempotency-Key", key)
+	return s
+}
+
+// RequestID generates a random id for the request and sends it as X-Request-Id.
+// The id can be read back with GetRequestID to correlate logs.
+func (s *HttpAgent) RequestID() *HttpAgent {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		s.Errors = append(s.Errors, err)
+		return s
+	}
+	// uuid version 4 layout
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	id := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	s.setRequestHeader("X-Request-Id", id)
+	s.requestID = id
+	return s
+}
+
+// GetRequestID returns the id generated by RequestID for the current request, or "" if there is none.
+func (s *HttpAgent) GetRequestID() string {
+	return s.requestID
+}
+
 // AddCookie adds a cookie to the request. The behavior is the same as AddCookie on Request from net/http
 func (s *HttpAgent) AddCookie(c *http.Cookie) *HttpAgent {
 	s.Cookies = append(s.Cookies, c)
 	return s
 }
 
+// AddCookies adds a slice of cookies to the request.
+func (s *HttpAgent) AddCookies(cs []*http.Cookie) *HttpAgent {
+	s.Cookies = append(s.Cookies, cs...)
+	return s
+}
+
+// SetCookieString parses a Cookie header as copied from a browser, like "a=1; b=2", and adds each cookie to the request.
+// A leading "Cookie:" is allowed.
+func (s *HttpAgent) SetCookieString(cookie string) *HttpAgent {
+	cookie = strings.TrimSpace(cookie)
+	if len(cookie) >= 7 && strings.EqualFold(cookie[:7], "cookie:") {
+		cookie = strings.TrimSpace(cookie[7:])
+	}
+	req := &http.Request{Header: http.Header{"Cookie": {cookie}}}
+	return s.AddCookies(req.Cookies())
+}
+
 var Types = map[string]string{
 	"html":       "text/html",
 	"json":       "application/json",
@@ -182,6 +435,7 @@ var Types = map[string]string{
 	"form-data":  "application/x-www-form-urlencoded",
 	"text":       "text/plain",
 	"multipart":  "multipart/form-data",
+	"related":    "multipart/related",
 	"stream":     "application/octet-stream",
 }
 
@@ -202,16 +456,101 @@ var Types = map[string]string{
 //    "application/json" uses "json"
 //    "application/xml" uses "xml"
 //    "application/x-www-form-urlencoded" uses "urlencoded", "form" or "form-data"
+//    "multipart/form-data" uses "multipart"
+//    "multipart/related" uses "related", the data sent is the json metadata part followed by the file from SendFile,
+//      its type parameter names the first part, the root
+//
+// A full MIME type such as "application/vnd.api+json" or "application/x-protobuf" is accepted too and used as the Content-Type as is.
+// The body is then sent raw: a string from Send/SendString or the bytes from SendBytes go out verbatim,
+// while structs and maps given to Send are encoded as json.
 //
 func (s *HttpAgent) Type(typeStr string) *HttpAgent {
 	if _, ok := Types[typeStr]; ok {
 		s.ForceType = typeStr
+	} else if strings.Contains(typeStr, "/") {
+		s.ForceType = "raw"
+		s.ContentType = typeStr
 	} else {
 		s.Errors = append(s.Errors, errors.New("Type func: incorrect type \""+typeStr+"\""))
 	}
 	return s
 }
 
+// AutoAccept sends an Accept header matching the type of the request, so a json request asks for json back:
+//
+//      gohttp.New().
+//        AutoAccept(true).
+//        Post("http://example.com/api").
+//        Send(payload).
+//        End() // Accept: application/json
+//
+// The type is the one from Type, or the one derived from the data sent, looked up in Types. Form and
+// multipart types say nothing about the response and send no Accept. An Accept set with Set always wins.
+func (s *HttpAgent) AutoAccept(on bool) *HttpAgent {
+	s.AutoAcceptType = on
+	return s
+}
+
+// acceptType returns the Accept header AutoAccept sends for the request type, "" for none.
+func (s *HttpAgent) acceptType() string {
+	t := s.bodyType()
+	if s.ForceType != "" {
+		t = s.ForceType
+	}
+	switch t {
+	case "form", "urlencoded", "form-data", "multipart", "related":
+		return ""
+	case "raw":
+		return s.ContentType
+	}
+	return Types[t]
+}
+
+// CompressBody compresses the request body with encoding, "gzip" or "br", and sets Content-Encoding.
+// An empty encoding means gzip. The body is compressed in memory before it is sent:
+//
+//      gohttp.New().
+//        Post("http://example.com/bulk").
+//        CompressBody("br").
+//        Send(documents).
+//        End()
+//
+func (s *HttpAgent) CompressBody(encoding string) *HttpAgent {
+	if encoding == "" {
+		encoding = "gzip"
+	}
+	switch encoding {
+	case "gzip", "br":
+		s.BodyEncoding = encoding
+	default:
+		s.Errors = append(s.Errors, errors.New("CompressBody func: unsupported encoding \""+encoding+"\""))
+	}
+	return s
+}
+
+// Charset sets the charset appended to the Content-Type of json, form, text and xml bodies, UTF-8 by default.
+// An empty charset sends the bare media type. A Content-Type set with Set is sent as is.
+//
+//      gohttp.New().
+//        Post("/legacy").
+//        Type("form").
+//        Charset("GBK").
+//        Send("name=...").
+//        End()
+//
+func (s *HttpAgent) Charset(charset string) *HttpAgent {
+	s.ContentCharset = charset
+	return s
+}
+
+// withCharset appends the agent's charset to the media type.
+func (s *HttpAgent) withCharset(mime string) string {
+	if s.ContentCharset == "" {
+		return mime
+	}
+	return mime + "; charset=" + s.ContentCharset
+}
+
 // Query function accepts either json string or strings which will form a query-string in url of GET method or body of POST method.
 // For example, making "/search?query=bicycle&size=50x50&weight=20kg" using GET method:
 //
@@ -257,6 +596,24 @@ func (s *HttpAgent) Query(content interface{}) *HttpAgent {
 }
 
 func (s *HttpAgent) queryStruct(content interface{}) *HttpAgent {
+	return s.queryStructFormat(content, s.arrayFormat())
+}
+
+// QueryCSV adds the fields of a struct or map to the query-string like Query, joining slice fields
+// with commas whatever ArrayFormat says, as Elasticsearch-style APIs expect:
+//
+//      gohttp.New().
+//        Get("/_search").
+//        QueryCSV(struct {
+//          Fields []string `json:"fields"`
+//        }{[]string{"a", "b"}}). // fields=a,b
+//        End()
+//
+func (s *HttpAgent) QueryCSV(v interface{}) *HttpAgent {
+	return s.queryStructFormat(v, ArrayComma)
+}
+
+func (s *HttpAgent) queryStructFormat(content interface{}, format string) *HttpAgent {
 	if marshalContent, err := json.Marshal(content); err != nil {
 		s.Errors = append(s.Errors, err)
 	} else {
@@ -264,10 +621,15 @@ func (s *HttpAgent) queryStruct(content interface{}) *HttpAgent {
 		if err := json_unmarshal(marshalContent, &val); err != nil {
 			s.Errors = append(s.Errors, err)
 		} else {
-			newdata := changeMapToURLValues(val)
-			for k, v := range newdata {
-				for _, v1 := range v {
-					s.QueryData.Add(k, v1)
+			newdata := changeMapToURLValues(val, format)
+			keys := make([]string, 0, len(newdata))
+			for k := range newdata {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				for _, v1 := range newdata[k] {
+					s.addQuery(k, v1)
 				}
 			}
 		}
@@ -279,12 +641,18 @@ func (s *HttpAgent) queryString(content string) *HttpAgent {
 	var val map[string]string
 	if err := json.Unmarshal([]byte(content), &val); err == nil {
 		for k, v := range val {
-			s.QueryData.Add(k, v)
+			s.addQuery(k, v)
 		}
 	} else {
-		if queryVal, err := url.ParseQuery(content); err == nil {
-			for k, _ := range queryVal {
-				s.QueryData.Add(k, queryVal.Get(k))
+		if _, err := url.ParseQuery(content); err == nil {
+			// pair by pair, so that OrderedQuery keeps their order
+			for _, pair := range strings.Split(content, "&") {
+				queryVal, _ := url.ParseQuery(pair)
+				for k, vals := range queryVal {
+					for _, v := range vals {
+						s.addQuery(k, v)
+					}
+				}
 			}
 		} else {
 			s.Errors = append(s.Errors, err)
@@ -298,11 +666,171 @@ func (s *HttpAgent) queryString(content string) *HttpAgent {
 // Thus, Query won't accept ; in a querystring if we provide something like fields=f1;f2;f3
 // This Param is then created as an alternative method to solve this.
 func (s *HttpAgent) Param(key string, value string) *HttpAgent {
+	s.addQuery(key, value)
+	return s
+}
+
+// Params adds all values to the query-string parameter key, for APIs taking a repeated parameter:
+//
+//      gohttp.New().
+//        Get("http://example.com/api/users").
+//        Params("fields", "id", "name", "email"). // ?fields=id&fields=name&fields=email
+//        End()
+//
+func (s *HttpAgent) Params(key string, values ...string) *HttpAgent {
+	for _, value := range values {
+		s.addQuery(key, value)
+	}
+	return s
+}
+
+// SetParam sets the query-string parameter key to value, replacing the values added before,
+// so a page number can change from one request to the next without piling up.
+func (s *HttpAgent) SetParam(key string, value string) *HttpAgent {
+	s.QueryData.Del(key)
+	s.addQuery(key, value)
+	return s
+}
+
+// ClearQuery drops every query-string parameter added so far with Query, Param and the like.
+func (s *HttpAgent) ClearQuery() *HttpAgent {
+	s.QueryData = url.Values{}
+	s.queryKeys = nil
+	return s
+}
+
+// RawQuery sends q as the query-string, verbatim: it is neither parsed nor encoded again, so a query
+// already encoded and signed goes out byte for byte. It replaces the query of the url and overrides
+// everything added with Query, Param and the like. An empty q goes back to those:
+//
+//      gohttp.New().
+//        Get("https://api.example.com/v1/orders").
+//        RawQuery("a=b%20c&sig=" + sig).
+//        End()
+//
+func (s *HttpAgent) RawQuery(q string) *HttpAgent {
+	s.rawQuery = q
+	return s
+}
+
+// OrderedQuery sends the query-string parameters in the order they were added instead of sorted by key,
+// for APIs signing the query as sent. The values of a key stay together, in their order, at the place
+// of the first one. Parameters already in the url come first, untouched:
+//
+//      gohttp.New().
+//        OrderedQuery().
+//        Get("https://pay.example.com/api").
+//        Param("timestamp", ts).
+//        Param("amount", "100").
+//        Param("sign", sign). // ?timestamp=...&amount=100&sign=...
+//        End()
+//
+// Maps given to Query, ParamMap or ParamValues have no order of their own, add the parameters whose order matters with Param.
+func (s *HttpAgent) OrderedQuery() *HttpAgent {
+	s.QueryOrdered = true
+	return s
+}
+
+// addQuery adds value to the query-string parameter key, noting the order keys come in.
+func (s *HttpAgent) addQuery(key string, value string) {
+	if _, ok := s.QueryData[key]; !ok {
+		s.queryKeys = append(s.queryKeys, key)
+	}
 	s.QueryData.Add(key, value)
+}
+
+// encodeQuery encodes QueryData in the order the keys were added, keys set directly
+// on QueryData come last, sorted.
+func (s *HttpAgent) encodeQuery() string {
+	keys := make([]string, 0, len(s.QueryData))
+	seen := make(map[string]bool, len(s.QueryData))
+	for _, k := range s.queryKeys {
+		if _, ok := s.QueryData[k]; ok && !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	var rest []string
+	for k := range s.QueryData {
+		if !seen[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	keys = append(keys, rest...)
+
+	var buf strings.Builder
+	for _, k := range keys {
+		for _, v := range s.QueryData[k] {
+			if buf.Len() > 0 {
+				buf.WriteByte('&')
+			}
+			buf.WriteString(url.QueryEscape(k))
+			buf.WriteByte('=')
+			buf.WriteString(url.QueryEscape(v))
+		}
+	}
+	return buf.String()
+}
+
+// ParamValues adds every value of v to the query-string, values are kept as is like with Param.
+func (s *HttpAgent) ParamValues(v url.Values) *HttpAgent {
+	for key, values := range v {
+		for _, value := range values {
+			s.addQuery(key, value)
+		}
+	}
+	return s
+}
+
+// ParamMap adds every key and value of m to the query-string, values are kept as is like with Param.
+func (s *HttpAgent) ParamMap(m map[string]string) *HttpAgent {
+	for key, value := range m {
+		s.addQuery(key, value)
+	}
 	return s
 }
 
+// TotalTimeout bounds the whole request, all attempts included when it is retried, and reading the body.
+// Unlike Timeout, which applies to each attempt, an attempt in flight is cancelled once the budget is spent.
+func (s *HttpAgent) TotalTimeout(timeout time.Duration) *HttpAgent {
+	s.MaxTotalTimeout = timeout
+	return s
+}
+
+// Deadline makes the current request fail with context.DeadlineExceeded when it is not done by t,
+// reading the body included. It composes with Timeout and TotalTimeout, the tighter limit wins, but
+// only a missed deadline or TotalTimeout gives context.DeadlineExceeded itself, a Timeout gives a *url.Error:
+//
+//      _, errs := gohttp.New().
+//        Get("http://example.com/report").
+//        Deadline(time.Now().Add(10 * time.Second)).
+//        End()
+//      if errs != nil && errs[0] == context.DeadlineExceeded {
+//        // too late
+//      }
+//
+func (s *HttpAgent) Deadline(t time.Time) *HttpAgent {
+	s.startRequest()
+	s.deadline = t
+	return s
+}
+
+// WithContext sets the context of the request, cancelling the context aborts the request
+// as well as reading a streamed body like EventStream.
+func (s *HttpAgent) WithContext(ctx context.Context) *HttpAgent {
+	s.Context = ctx
+	return s
+}
+
+// Timeout sets the time limit of the whole request of this agent, reading the body included.
+// Without it Option.Timeout applies, a timeout <= 0 lets the request run without limit, as long downloads need.
+// The streaming helpers WriteTo, ToJSONLines and EventStream run without limit unless Timeout is set.
 func (s *HttpAgent) Timeout(timeout time.Duration) *HttpAgent {
+	if timeout <= 0 {
+		// negative marks an explicit "no timeout", zero means the default
+		timeout = -1
+	}
 	s.MaxTimeout = timeout
 	return s
 }
@@ -314,11 +842,72 @@ func (s *HttpAgent) Timeout(timeout time.Duration) *HttpAgent {
 // 				Get("https://disable-security-check.com").
 // 				End()
 //
+// The config only applies to this agent, it is set on a copy of the shared transport.
+// Agents without a TLS config use the default verification.
 func (s *HttpAgent) TLSClientConfig(config *tls.Config) *HttpAgent {
 	s.TlsConfig = config
 	return s
 }
 
+// TLSVersion sets the minimum and maximum TLS version of this agent, like tls.VersionTLS12 and tls.VersionTLS13.
+// Zero leaves the Go default for that bound.
+func (s *HttpAgent) TLSVersion(min, max uint16) *HttpAgent {
+	config := s.editTLSConfig()
+	config.MinVersion = min
+	config.MaxVersion = max
+	return s
+}
+
+// InsecureSkipVerify turns certificate verification off (or on again) for this agent only.
+func (s *HttpAgent) InsecureSkipVerify(skip bool) *HttpAgent {
+	s.editTLSConfig().InsecureSkipVerify = skip
+	return s
+}
+
+// editTLSConfig returns the agent's TLS config ready to be modified.
+// It is cloned so a config shared through TLSClientConfig is not modified.
+func (s *HttpAgent) editTLSConfig() *tls.Config {
+	if s.TlsConfig == nil {
+		s.TlsConfig = &tls.Config{}
+	} else {
+		s.TlsConfig = s.TlsConfig.Clone()
+	}
+	return s.TlsConfig
+}
+
+// ClientCert loads a client certificate for mutual TLS from a pair of PEM encoded files.
+// The certificate is merged into the agent's TLS config, so RootCAs or InsecureSkipVerify set by TLSClientConfig are kept:
+//
+//      gohttp.New().
+//        Get("https://mtls.example.com").
+//        ClientCert("client.crt", "client.key").
+//        End()
+//
+func (s *HttpAgent) ClientCert(certFile, keyFile string) *HttpAgent {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		s.Errors = append(s.Errors, err)
+		return s
+	}
+	return s.addClientCert(cert)
+}
+
+// ClientCertPEM is the same as ClientCert but takes the PEM encoded certificate and key directly.
+func (s *HttpAgent) ClientCertPEM(certPEM, keyPEM []byte) *HttpAgent {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		s.Errors = append(s.Errors, err)
+		return s
+	}
+	return s.addClientCert(cert)
+}
+
+func (s *HttpAgent) addClientCert(cert tls.Certificate) *HttpAgent {
+	config := s.editTLSConfig()
+	config.Certificates = append(config.Certificates, cert)
+	return s
+}
+
 // Proxy function accepts a proxy url string to setup proxy url for any request.
 // It provides a convenience way to setup proxy which have advantages over usual old ways.
 // One example is you might try to set `http_proxy` environment. This means you are setting proxy up for all the requests.
@@ -340,11 +929,68 @@ func (s *HttpAgent) Proxy(proxyUrl string) *HttpAgent {
 	return s
 }
 
+// MaxRedirect limits how many redirects are followed. With 0 no redirect is followed at all and the
+// 3xx response is returned as is, without error. Past a limit greater than 0, End returns an error.
 func (s *HttpAgent) MaxRedirect(redirect int) *HttpAgent {
 	s.MaxRedirects = redirect
 	return s
 }
 
+// OnRedirect calls fn on each redirect hop, before it is followed: req is the next request, its headers
+// already copied from the first one, and via the requests made so far, oldest first. fn can log the
+// Location, rewrite req, or stop there by returning an error, which End returns. Return http.ErrUseLastResponse
+// to stop without error, with the redirect response. MaxRedirect and SameHostRedirectsOnly are checked after fn:
+//
+//      var hops []string
+//      gohttp.New().
+//        OnRedirect(func(req *http.Request, via []*http.Request) error {
+//          hops = append(hops, req.URL.String())
+//          return nil
+//        }).
+//        Get("https://bit.ly/xxxx").
+//        End()
+//
+// With MaxRedirect(0) no redirect is followed and fn is not called.
+func (s *HttpAgent) OnRedirect(fn func(req *http.Request, via []*http.Request) error) *HttpAgent {
+	s.RedirectFn = fn
+	return s
+}
+
+// SameHostRedirectsOnly stops at any redirect leaving the host of the request: End then returns
+// a *RedirectHostError, wrapped in the *url.Error of the client, and no request reaches the other host.
+// It keeps a crawler on the site it was sent to. Any MaxRedirect limit still applies.
+func (s *HttpAgent) SameHostRedirectsOnly() *HttpAgent {
+	s.SameHostOnly = true
+	return s
+}
+
+// AllowErrorBody makes Bytes and String read the body even when End reports a soft error,
+// returning the body along with the error. Soft errors are those stopping a redirect, a response
+// being there all the same: the MaxRedirect limit reached and a redirect refused by SameHostRedirectsOnly.
+// The body is then the one of the last redirect response. Any other error still returns no body:
+//
+//      body, code, err := gohttp.New().
+//        AllowErrorBody().
+//        MaxRedirect(2).
+//        Get("http://example.com/loop").
+//        String()
+//
+// End returns the redirect response, its body open, together with the error.
+func (s *HttpAgent) AllowErrorBody() *HttpAgent {
+	s.ErrorBody = true
+	return s
+}
+
+// RedirectHostError is returned by End when SameHostRedirectsOnly stops a redirect to another host.
+type RedirectHostError struct {
+	Host   string
+	Target string
+}
+
+func (e *RedirectHostError) Error() string {
+	return fmt.Sprintf("redirect from host %s to %s refused", e.Host, e.Target)
+}
+
 //func (s *HttpAgent) RedirectPolicy(policy func(req Request, via []Request) error) *HttpAgent {
 //	s.Client.CheckRedirect = func(r *http.Request, v []*http.Request) error {
 //		vv := make([]Request, len(v))
@@ -393,6 +1039,9 @@ func (s *HttpAgent) MaxRedirect(redirect int) *HttpAgent {
 //        Send(`{"Safari":"5.1.10"}`).
 //        End()
 //
+// Numbers and booleans are sent as the whole json body, so Send(42) posts `42`.
+// Such a primitive body replaces any data sent before instead of merging into it.
+//
 func (s *HttpAgent) Send(content interface{}) *HttpAgent {
 	// TODO: add normal text mode or other mode to Send func
 	switch v := reflect.ValueOf(content); v.Kind() {
@@ -402,8 +1051,13 @@ func (s *HttpAgent) Send(content interface{}) *HttpAgent {
 		s.sendArray(v.Interface())
 	case reflect.Struct, reflect.Map:
 		s.sendStruct(v.Interface())
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		s.DataAll = v.Interface()
 	default:
-		// TODO: leave default for handling other types in the future such as number, byte, etc...
+		// TODO: leave default for handling other types in the future such as byte, etc...
 	}
 	return s
 }
@@ -441,7 +1095,7 @@ func (s *HttpAgent) sendStruct(content interface{}) *HttpAgent {
 }
 
 func (s *HttpAgent) SendBytes(data []byte) *HttpAgent {
-	if s.ForceType == "stream" {
+	if s.ForceType == "stream" || s.ForceType == "raw" {
 		s.Data["stream"] = data
 		return s
 	}
@@ -449,29 +1103,124 @@ func (s *HttpAgent) SendBytes(data []byte) *HttpAgent {
 	return s.SendString(string(data))
 }
 
+// SetBody sends r as the body, byte for byte, with the given Content-Type (none when empty).
+// It skips all the serialization done by Send and Type, anything sent with them is ignored.
+// This is the way to post a pre-signed payload or a protobuf blob:
+//
+//      gohttp.New().
+//        Post("http://example.com/upload").
+//        SetBody(bytes.NewReader(blob), "application/x-protobuf").
+//        End()
+//
+func (s *HttpAgent) SetBody(r io.Reader, contentType string) *HttpAgent {
+	s.Body = r
+	s.ContentType = contentType
+	return s
+}
+
+// SendReader streams r as the body, for example to pass on an upstream response. length is the size of
+// the body when known, a negative length sends it with chunked transfer encoding. The Content-Type
+// is application/octet-stream unless given with Type or Set:
+//
+//      resp, _ := http.Get(upstream)
+//      gohttp.New().
+//        Put("http://example.com/mirror").
+//        SendReader(resp.Body, resp.ContentLength).
+//        End()
+//
+func (s *HttpAgent) SendReader(r io.Reader, length int64) *HttpAgent {
+	s.Body = r
+	s.BodyLength = length
+	if s.ContentType == "" {
+		s.ContentType = Types["stream"]
+	}
+	return s
+}
+
 func (s *HttpAgent) SendParam(key string, value interface{}) *HttpAgent {
 	s.Data[key] = value
 	return s
 }
 
-// SendString returns HttpAgent's itself for any next chain and takes content string as a parameter.
-// Its duty is to transform String into s.Data (map[string]interface{}) which later changes into appropriate format such as json, form, text, etc. in the End func.
-// Send implicitly uses SendString and you should use Send instead of this.
-func (s *HttpAgent) SendString(content string) *HttpAgent {
-	if s.ForceType == "text" || s.ForceType == "xml" {
-		s.Data["text"] = content
-		//s.TargetType = s.ForceType
-		return s
+// SendForm sends data as an application/x-www-form-urlencoded body, without guessing the type like SendString does.
+func (s *HttpAgent) SendForm(data map[string]string) *HttpAgent {
+	for k, v := range data {
+		s.Data[k] = v
 	}
+	s.TargetType = "form"
+	return s
+}
 
-	var val map[string]interface{}
-	var valslice []interface{}
-	// check if it is json format
-	if err := json_unmarshal([]byte(content), &val); err == nil {
-		for k, v := range val {
-			s.Data[k] = v
+// SendFormValues is the same as SendForm for url.Values. A key with several values is sent
+// as an array, in the format set by ArrayFormat.
+func (s *HttpAgent) SendFormValues(values url.Values) *HttpAgent {
+	for k, v := range values {
+		if len(v) == 1 {
+			s.Data[k] = v[0]
+		} else {
+			s.Data[k] = append([]string(nil), v...)
 		}
-	} else if err := json_unmarshal([]byte(content), &valslice); err == nil {
+	}
+	s.TargetType = "form"
+	return s
+}
+
+// AddField appends value to the form field key, kept apart from the data given to Send.
+// Calling it again with the same key repeats the field, without brackets whatever ArrayFormat says:
+//
+//      gohttp.New().
+//        Post("/tags").
+//        AddField("tags", "a").
+//        AddField("tags", "b"). // tags=a&tags=b
+//        End()
+//
+// The fields go into form and multipart bodies.
+func (s *HttpAgent) AddField(key string, value string) *HttpAgent {
+	s.FormData.Add(key, value)
+	s.TargetType = "form"
+	return s
+}
+
+// typedField is a multipart form field sent with its own Content-Type.
+type typedField struct {
+	name  string
+	value string
+	ctype string
+}
+
+// AddFieldWithType adds a form field to a multipart body, its part carrying ctype as Content-Type.
+// It mixes a json metadata field with file parts for APIs that check the type of each part:
+//
+//      gohttp.New().
+//        Post("http://example.com/upload").
+//        AddFieldWithType("metadata", `{"title":"report"}`, "application/json").
+//        SendFile("./report.pdf").
+//        End()
+//
+func (s *HttpAgent) AddFieldWithType(key, value, ctype string) *HttpAgent {
+	s.typedFields = append(s.typedFields, typedField{key, value, ctype})
+	s.TargetType = "multipart"
+	return s
+}
+
+// SendString returns HttpAgent's itself for any next chain and takes content string as a parameter.
+// Its duty is to transform String into s.Data (map[string]interface{}) which later changes into appropriate format such as json, form, text, etc. in the End func.
+// Send implicitly uses SendString and you should use Send instead of this.
+func (s *HttpAgent) SendString(content string) *HttpAgent {
+	if s.ForceType == "text" || s.ForceType == "xml" || s.ForceType == "raw" {
+		s.Data["text"] = content
+		//s.TargetType = s.ForceType
+		return s
+	}
+
+	var val map[string]interface{}
+	var valslice []interface{}
+	// check if it is json format
+	if err := json_unmarshal([]byte(content), &val); err == nil {
+		for k, v := range val {
+			s.Data[k] = v
+		}
+	} else if err := json_unmarshal([]byte(content), &valslice); err == nil {
 		s.DataAll = valslice
 	} else if formVal, err := url.ParseQuery(content); err == nil {
 		for k, _ := range formVal {
@@ -505,9 +1254,14 @@ type File struct {
 	Reader      io.Reader
 	Len         int64
 	ContentType string
+	// Header holds extra headers of the part, like Content-Encoding
+	Header map[string]string
+	// path is the file SendFile was given, opened only when the request is built
+	path string
 }
 
-// SendFile function works only with type "multipart". The function accepts one mandatory and up to two optional arguments. The mandatory (first) argument is the file.
+// SendFile function works only with type "multipart", which is picked on its own when no other type is set with Type:
+// fields given to Send then go along with the files. The function accepts one mandatory and up to two optional arguments. The mandatory (first) argument is the file.
 // The function accepts a path to a file as string:
 //
 //      gorequest.New().
@@ -516,6 +1270,11 @@ type File struct {
 //        SendFile("./example_file.ext").
 //        End()
 //
+// The file is only opened by End, read while the request is sent, straight from disk,
+// and closed once done, so an agent that is never sent holds no open file.
+//
+// Uploads work the same with Put and Patch, for APIs replacing a file with PUT.
+//
 // File can also be a []byte slice of a already file read by eg. ioutil.ReadFile:
 //
 //      b, _ := ioutil.ReadFile("./example_file.ext")
@@ -585,7 +1344,7 @@ func (s *HttpAgent) SendFile(file interface{}, args ...string) *HttpAgent {
 		if filename == "" {
 			filename = filepath.Base(pathToFile)
 		}
-		data, err := ioutil.ReadFile(v)
+		stat, err := os.Stat(v)
 		if err != nil {
 			s.Errors = append(s.Errors, err)
 			return s
@@ -593,9 +1352,9 @@ func (s *HttpAgent) SendFile(file interface{}, args ...string) *HttpAgent {
 		s.FileData = append(s.FileData, File{
 			Filename:    filename,
 			Fieldname:   fieldname,
-			Reader:      bytes.NewReader(data),
-			Len:         int64(len(data)),
+			Len:         stat.Size(),
 			ContentType: ctype,
+			path:        v,
 		})
 	case []byte:
 		if filename == "" {
@@ -614,11 +1373,20 @@ func (s *HttpAgent) SendFile(file interface{}, args ...string) *HttpAgent {
 		if filename == "" {
 			filename = filepath.Base(osfile.Name())
 		}
-		stat, _ := osfile.Stat()
+		stat, err := osfile.Stat()
+		if err != nil {
+			s.Errors = append(s.Errors, err)
+			return s
+		}
+		// pipes and sockets have no meaningful size, they are sent chunked
+		size := int64(-1)
+		if stat.Mode().IsRegular() {
+			size = stat.Size()
+		}
 		s.FileData = append(s.FileData, File{
 			Filename:    filename,
 			Fieldname:   fieldname,
-			Len:         stat.Size(),
+			Len:         size,
 			Reader:      osfile,
 			ContentType: ctype,
 		})
@@ -629,7 +1397,160 @@ func (s *HttpAgent) SendFile(file interface{}, args ...string) *HttpAgent {
 	return s
 }
 
-func changeMapToURLValues(data map[string]interface{}) url.Values {
+// openFileData returns the files of the body, the ones SendFile was given by path opened now.
+// They are closed by closeFiles once the request is done.
+func (s *HttpAgent) openFileData() ([]File, error) {
+	files := make([]File, len(s.FileData))
+	for i, f := range s.FileData {
+		if f.path != "" {
+			fh, err := os.Open(f.path)
+			if err != nil {
+				return nil, err
+			}
+			s.openFiles = append(s.openFiles, fh)
+			stat, err := fh.Stat()
+			if err != nil {
+				return nil, err
+			}
+			f.Reader, f.Len = fh, stat.Size()
+		}
+		files[i] = f
+	}
+	return files, nil
+}
+
+// closeFiles closes the files SendFile opened from a path.
+func (s *HttpAgent) closeFiles() {
+	for _, f := range s.openFiles {
+		f.Close()
+	}
+	s.openFiles = nil
+}
+
+// SendFiles adds every file of paths to a multipart body, the content type guessed from the extension.
+// The fields are named fieldname1, fieldname2 and so on, unless fieldname ends with "[]" like "files[]",
+// which is then repeated as is. A path that can't be read is reported in the errors, the others are still added:
+//
+//      gohttp.New().
+//        Post("http://example.com/upload").
+//        Type("multipart").
+//        SendFiles([]string{"a.png", "b.png"}, "files[]").
+//        End()
+//
+func (s *HttpAgent) SendFiles(paths []string, fieldname string) *HttpAgent {
+	for i, path := range paths {
+		name := fieldname
+		if !strings.HasSuffix(fieldname, "[]") {
+			name = fieldname + strconv.Itoa(i+1)
+		}
+		s.SendFile(path, "", name, mime.TypeByExtension(filepath.Ext(path)))
+	}
+	return s
+}
+
+// FileHeader adds a header to the part of the file added last by SendFile or SendReaderFile,
+// for example to upload content that is already compressed:
+//
+//      gohttp.New().
+//        Post("http://example.com/upload").
+//        Type("multipart").
+//        SendFile(gzipped, "data.json.gz").
+//        FileHeader("Content-Encoding", "gzip").
+//        End()
+//
+func (s *HttpAgent) FileHeader(key string, value string) *HttpAgent {
+	if len(s.FileData) == 0 {
+		s.Errors = append(s.Errors, errors.New("FileHeader func: no file to set the header on"))
+		return s
+	}
+	f := &s.FileData[len(s.FileData)-1]
+	if f.Header == nil {
+		f.Header = make(map[string]string)
+	}
+	f.Header[key] = value
+	return s
+}
+
+// SendReaderFile adds a file read from r to a multipart body, for content generated on the fly
+// that never touches the disk. length must be the exact number of bytes r yields, it goes into
+// the Content-Length of the request, or -1 when unknown to send the body chunked. fieldname defaults to "file":
+//
+//      gohttp.New().
+//        Post("http://example.com/upload").
+//        Type("multipart").
+//        SendReaderFile(zipReader, zipSize, "backup.zip", "archive").
+//        End()
+//
+func (s *HttpAgent) SendReaderFile(r io.Reader, length int64, filename string, fieldname string) *HttpAgent {
+	if length < 0 {
+		length = -1
+	}
+	if fieldname == "" {
+		fieldname = "file"
+	}
+	if filename == "" {
+		filename = "filename"
+	}
+	s.FileData = append(s.FileData, File{
+		Filename:  filename,
+		Fieldname: fieldname,
+		Reader:    r,
+		Len:       length,
+	})
+	return s
+}
+
+// Array formats control how slice values are serialized into query strings and form bodies.
+const (
+	ArrayBrackets = "brackets" // key[]=v1&key[]=v2
+	ArrayRepeat   = "repeat"   // key=v1&key=v2
+	ArrayComma    = "comma"    // key=v1,v2
+)
+
+// ArrayFormat sets how slice values are serialized for this agent, overriding Option.ArrayFormat.
+// It accepts ArrayBrackets, ArrayRepeat or ArrayComma:
+//
+//      gohttp.New().
+//        Get("/search").
+//        ArrayFormat(gohttp.ArrayRepeat).
+//        Query(map[string]interface{}{"id": []int{1, 2}}).
+//        End()
+//
+// This will request "/search?id=1&id=2" instead of "/search?id[]=1&id[]=2".
+// Call it before Query so the query data is serialized with the chosen format.
+func (s *HttpAgent) ArrayFormat(format string) *HttpAgent {
+	switch format {
+	case ArrayBrackets, ArrayRepeat, ArrayComma:
+		s.ArrayStyle = format
+	default:
+		s.Errors = append(s.Errors, errors.New("ArrayFormat func: incorrect format \""+format+"\""))
+	}
+	return s
+}
+
+func (s *HttpAgent) arrayFormat() string {
+	if s.ArrayStyle != "" {
+		return s.ArrayStyle
+	}
+	return s.option().ArrayFormat
+}
+
+func addURLValuesArray(values url.Values, key string, elements []string, format string) {
+	switch format {
+	case ArrayRepeat:
+		for _, element := range elements {
+			values.Add(key, element)
+		}
+	case ArrayComma:
+		values.Add(key, strings.Join(elements, ","))
+	default:
+		for _, element := range elements {
+			values.Add(key+"[]", element)
+		}
+	}
+}
+
+func changeMapToURLValues(data map[string]interface{}, format string) url.Values {
 	var newUrlValues = url.Values{}
 	for k, v := range data {
 		switch val := v.(type) {
@@ -649,13 +1570,13 @@ func changeMapToURLValues(data map[string]interface{}) url.Values {
 			newUrlValues.Add(k, val)
 		case []int, []int64, []float64, []interface{}:
 			v := reflect.ValueOf(val)
+			elements := make([]string, v.Len())
 			for i := 0; i < v.Len(); i++ {
-				newUrlValues.Add(fmt.Sprintf("%s[]", k), fmt.Sprintf("%v", v.Index(i).Interface()))
+				elements[i] = fmt.Sprintf("%v", v.Index(i).Interface())
 			}
+			addURLValuesArray(newUrlValues, k, elements, format)
 		case []string:
-			for _, element := range val {
-				newUrlValues.Add(fmt.Sprintf("%s[]", k), element)
-			}
+			addURLValuesArray(newUrlValues, k, val, format)
 		default:
 			body, _ := json.Marshal(val)
 			newUrlValues.Add(k, string(body))
@@ -665,11 +1586,149 @@ func changeMapToURLValues(data map[string]interface{}) url.Values {
 	return newUrlValues
 }
 
+// Jar tells whether requests of this agent use the cookie jar, the one shared by the client getter
+// or the agent's own from PrivateJar. With Jar(false) the jar is neither read nor written: each request
+// gets a throwaway jar, so cookies only follow its redirects and never leak into later requests.
 func (s *HttpAgent) Jar(use bool) *HttpAgent {
 	s.Usejar = use
 	return s
 }
 
+// Close sends requests of this agent with "Connection: close", the connection is closed after the response
+// instead of going back to the pool. Unlike MaxIdleConns(0), which turns keep-alive off on the agent's transport,
+// only these requests are concerned: handy for an endpoint whose connections misbehave on reuse.
+func (s *HttpAgent) Close(close bool) *HttpAgent {
+	s.CloseConn = close
+	return s
+}
+
+// NoCookies sends the current request without any cookie, neither those of the jar nor those added
+// with AddCookie, and leaves the jar untouched by its response. Following requests of the agent use the jar again:
+//
+//      gohttp.New().
+//        Get("https://example.com/public").
+//        NoCookies().
+//        End()
+//
+func (s *HttpAgent) NoCookies() *HttpAgent {
+	s.startRequest()
+	s.noCookies = true
+	return s
+}
+
+// WithOption gives this agent options of its own, the default ones with the fields of o set, following
+// the rules of SetOption. It lets a polite and an aggressive crawler run side by side:
+//
+//      polite := gohttp.New().WithOption(&gohttp.Option{
+//        Delay:   2 * time.Second,
+//        Address: []string{"10.0.0.2"},
+//      })
+//
+// The agent's requests use the Agent, Timeout, MaxRedirects and ArrayFormat of these options, and clients
+// from a getter of their own: it rotates over the Address of the options, none when no address
+// is set anywhere, applies their Delay and builds transports from their ConnectTimeout, MaxIdleConns
+// and the like. Agents with equal options share that getter, their delays and connections, for the
+// 64 options used last. ResetCookie reaches the cookie jars of these getters too.
+// The default options are copied now, SetOption calls made later don't apply. A nil o goes back to the
+// default options. WithGetter and WithClient win over the getter of the options.
+func (s *HttpAgent) WithOption(o *Option) *HttpAgent {
+	if o == nil {
+		s.AgentOption = nil
+		s.optionGetter = nil
+		return s
+	}
+	option := mergeOption(GetOption(), o)
+	s.AgentOption = &option
+	s.optionGetter = optionClient(option)
+	return s
+}
+
+// option returns the options of the agent, those of WithOption or the default ones.
+func (s *HttpAgent) option() Option {
+	if s.AgentOption != nil {
+		return *s.AgentOption
+	}
+	return GetOption()
+}
+
+// BearerSource sends requests of this agent with "Authorization: Bearer <token>", fn giving the token.
+// fn is called before each request and each retry with refresh false, a token cache then returns its
+// token while it is valid. Before a retry after a 401 Unauthorized, refresh is true: the server refused the
+// token, the cache must fetch a new one. With a retry policy retrying 401 on top of the default statuses,
+// a request refused for an expired token is sent again with a fresh one:
+//
+//      policy := gohttp.DefaultRetryPolicy()
+//      retry := policy.RetryStatus
+//      policy.RetryStatus = func(code int) bool { return code == http.StatusUnauthorized || retry(code) }
+//
+//      gohttp.New().
+//        BearerSource(func(refresh bool) (string, error) {
+//          if refresh {
+//            tokens.Expire()
+//          }
+//          return tokens.Token()
+//        }).
+//        SetRetryPolicy(policy).
+//        Get("https://api.example.com/v1/me").
+//        End()
+//
+// When fn fails the request is not sent, End returns the error of fn. The token wins over an Authorization set with Set.
+// Neither follows a redirect to another host.
+func (s *HttpAgent) BearerSource(fn func(refresh bool) (string, error)) *HttpAgent {
+	s.TokenFn = fn
+	return s
+}
+
+// WithGetter makes this agent take its clients from g instead of the default client getter,
+// see ClientGetter. WithClient wins over it.
+func (s *HttpAgent) WithGetter(g ClientGetter) *HttpAgent {
+	s.Getter = g
+	return s
+}
+
+// WithClient sends the requests of this agent with c. The client getter is skipped entirely:
+// no IP rotation, no host delay and no shared cookie jar, c brings its own transport and jar.
+// Handy to plug in an instrumented or mocked client while keeping the request builder:
+//
+//      gohttp.New().
+//        WithClient(&http.Client{Transport: recorder}).
+//        Get("http://example.com/").
+//        End()
+//
+// c itself is never modified, the agent's redirect and timeout settings apply to a copy.
+func (s *HttpAgent) WithClient(c *http.Client) *HttpAgent {
+	s.Client = c
+	return s
+}
+
+// PrivateJar gives this agent its own cookie jar instead of the jar shared by the client getter.
+// The jar is created once and reused by all subsequent requests of the agent, so several login sessions
+// against the same site can run side by side in one process:
+//
+//      alice := gohttp.New().PrivateJar()
+//      bob := gohttp.New().PrivateJar()
+//
+func (s *HttpAgent) PrivateJar() *HttpAgent {
+	if s.CookieJar == nil {
+		s.CookieJar = MakeCookiejar()
+	}
+	return s
+}
+
+// ResetJar starts a new cookie session: a fresh jar replaces the agent's jar, while a client cached
+// by NewSingle keeps its transport and its warm connections. The new jar is private to the agent as with PrivateJar.
+// A client given to WithClient isn't modified, the jar goes on the copy End sends with.
+//
+//      req := gohttp.NewSingle()
+//      req.Post("http://example.com/login").Send(alice).End()
+//      req.ResetJar()
+//      req.Post("http://example.com/login").Send(bob).End()
+//
+func (s *HttpAgent) ResetJar() *HttpAgent {
+	s.CookieJar = MakeCookiejar()
+	return s
+}
+
 // End is the most important function that you need to call when ending the chain. The request won't proceed without calling it.
 // End function returns Response which matchs the structure of Response type in Golang's http package (but without Body data). The body data itself returns as a string in a 2nd return value.
 // Lastly but worht noticing, error array (NOTE: not just single error value) is returned as a 3rd value and nil otherwise.
@@ -692,6 +1751,8 @@ func (s *HttpAgent) Jar(use bool) *HttpAgent {
 //    }
 //    gohttp.New().Get("http://www..google.com").End(printBody)
 //
+// With a callback the body is read into memory first: the callback and the caller each get a copy of the
+// response with a Body of their own, both can read it. Use EndBytes to get the bytes directly.
 func (s *HttpAgent) End(callback ...func(response *http.Response, errs []error)) (*http.Response, []error) {
 	var (
 		req    *http.Request
@@ -699,17 +1760,41 @@ func (s *HttpAgent) End(callback ...func(response *http.Response, errs []error))
 		resp   *http.Response
 		client *http.Client
 	)
+	// files opened by SendFile are done with once the request is sent
+	defer s.closeFiles()
+	s.sent = true
+
 	// check whether there is an error. if yes, return all errors
 	if len(s.Errors) != 0 {
 		return nil, s.Errors
 	}
 
+	// an open circuit fails fast, without taking the host lock or waiting for the host delay
+	if uri, perr := url.Parse(s.Url); perr == nil {
+		if err = circuitOpen(uri.Host); err != nil {
+			s.Errors = append(s.Errors, err)
+			return nil, s.Errors
+		}
+	}
+
+	// with SerialPerHost the host stays locked until End returns, a body left open doesn't hold it
+	if unlock := lockHost(s.Url); unlock != nil {
+		defer unlock()
+	}
+
 	if s.Client != nil {
-		client = s.Client
+		// copied, End sets the redirect policy and timeout of the agent on it
+		c := *s.Client
+		if s.CookieJar != nil && s.Usejar {
+			c.Jar = s.CookieJar
+		}
+		client = &c
 	} else {
 		getter := GetDefaultGetter()
 		if s.Getter != nil {
 			getter = s.Getter
+		} else if s.optionGetter != nil {
+			getter = s.optionGetter
 		}
 
 		client, err = getter.GetHttpClient(s.Url, s.ProxyUrl, s.Usejar)
@@ -717,84 +1802,101 @@ func (s *HttpAgent) End(callback ...func(response *http.Response, errs []error))
 			s.Errors = append(s.Errors, err)
 			return nil, s.Errors
 		}
+		if s.CookieJar != nil && s.Usejar {
+			client.Jar = s.CookieJar
+		}
 		if s.SingleClient {
 			s.Client = client
 		}
 	}
+	if s.noCookies {
+		c := *client
+		c.Jar = nil
+		client = &c
+	}
 	transport, _ := client.Transport.(*http.Transport)
+	if t := s.agentTransport(transport); t != transport {
+		transport = t
+		client.Transport = t
+	}
 
-	// check if there is forced type
-	switch s.ForceType {
-	case "json", "form", "text", "xml", "multipart", "stream":
-		s.TargetType = s.ForceType
+	var token string
+	if s.TokenFn != nil {
+		if token, err = s.TokenFn(false); err != nil {
+			s.Errors = append(s.Errors, err)
+			return nil, s.Errors
+		}
 	}
 
-	switch s.Method {
-	case POST, PUT, PATCH:
-		if s.TargetType == "json" {
-			var contentJson []byte
-			if s.DataAll != nil {
-				contentJson, _ = json.Marshal(s.DataAll)
-			} else {
-				contentJson, _ = json.Marshal(s.Data)
-			}
-			contentReader := bytes.NewReader(contentJson)
-			req, err = http.NewRequest(s.Method, s.Url, contentReader)
-			req.Header.Set("Content-Type", "application/json; charset=UTF-8")
-		} else if s.TargetType == "form" {
-			formData := changeMapToURLValues(s.Data)
-			req, err = http.NewRequest(s.Method, s.Url, strings.NewReader(formData.Encode()))
-			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-		} else if s.TargetType == "text" {
-			formdata := s.Data["text"].(string)
-			req, err = http.NewRequest(s.Method, s.Url, strings.NewReader(formdata))
-			req.Header.Set("Content-Type", "text/plain")
-		} else if s.TargetType == "xml" {
-			formdata := s.Data["text"].(string)
-			req, err = http.NewRequest(s.Method, s.Url, strings.NewReader(formdata))
-			req.Header.Set("Content-Type", "text/xml")
-		} else if s.TargetType == "stream" {
-			body := s.Data["stream"].([]byte)
-			req, err = http.NewRequest(s.Method, s.Url, bytes.NewReader(body))
-			req.Header.Set("Content-Type", "application/octet-stream")
-		} else if s.TargetType == "multipart" {
+	req, err = s.newRequest()
+	if err != nil {
+		s.Errors = append(s.Errors, err)
+		return nil, s.Errors
+	}
 
-			mw := NewMultiPartStreamer()
+	req.Close = s.CloseConn
 
-			if len(s.Data) != 0 {
-				formData := changeMapToURLValues(s.Data)
-				mw.WriteFields(formData)
-			}
+	if s.ContinueTimeout > 0 && req.Body != nil && req.Body != http.NoBody {
+		req.Header.Set("Expect", "100-continue")
+	}
 
-			if len(s.FileData) > 0 {
-				// 暂时只支持单个文件
-				for _, file := range s.FileData {
-					mw.WriteReader(file)
-					// mw.WriteReader(file.Fieldname, file.Filename, file.Len, file.Reader)
-				}
-			}
+	if s.BodyEncoding != "" && req.Body != nil && req.Body != http.NoBody {
+		if err = compressBody(req, s.BodyEncoding); err != nil {
+			s.Errors = append(s.Errors, err)
+			return nil, s.Errors
+		}
+	}
 
-			req, err = http.NewRequest(s.Method, s.Url, nil)
-			mw.SetupRequest(req)
-			// req.Header.Set("Content-Type", mw.FormDataContentType())
+	// default headers go first so the agent's own headers override them,
+	// they don't replace the Content-Type of the body
+	for k, v := range GetDefaultHeaders() {
+		if req.Header.Get(k) == "" {
+			req.Header.Set(k, v)
+		}
+	}
+
+	if s.AutoAcceptType {
+		if accept := s.acceptType(); accept != "" {
+			req.Header.Set("Accept", accept)
 		}
-	case GET, HEAD, DELETE:
-		req, err = http.NewRequest(s.Method, s.Url, nil)
 	}
 
-	if _, ok := s.Header["User-Agent"]; !ok {
-		s.Header["User-Agent"] = defaultOption.Agent
+	if s.RawResponse && req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	if _, ok := s.Header["User-Agent"]; !ok && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", s.option().Agent)
 	}
 
 	if host, ok := s.Header["Host"]; ok {
 		req.Host = host
 	}
 
+	// a Content-Type set with Set wins over the one of the body,
+	// except that multipart bodies keep their boundary
 	for k, v := range s.Header {
+		if http.CanonicalHeaderKey(k) == "Content-Type" {
+			v = keepBoundary(v, req.Header.Get("Content-Type"))
+		}
+		req.Header.Set(k, v)
+	}
+	for k, v := range s.requestHeader {
 		req.Header.Set(k, v)
 	}
+	if s.TokenFn != nil {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 	// Add all querystring from Query func
-	if len(s.QueryData) > 0 {
+	if s.rawQuery != "" {
+		req.URL.RawQuery = s.rawQuery
+	} else if len(s.QueryData) > 0 && s.QueryOrdered {
+		query := s.encodeQuery()
+		if req.URL.RawQuery != "" {
+			query = req.URL.RawQuery + "&" + query
+		}
+		req.URL.RawQuery = query
+	} else if len(s.QueryData) > 0 {
 		q := req.URL.Query()
 		for k, v := range s.QueryData {
 			for _, vv := range v {
@@ -805,24 +1907,21 @@ func (s *HttpAgent) End(callback ...func(response *http.Response, errs []error))
 	}
 
 	// Add cookies
-	for _, cookie := range s.Cookies {
-		req.AddCookie(cookie)
-	}
-
-	if s.TlsConfig != nil {
-		transport.TLSClientConfig = s.TlsConfig
-	} else if transport != nil && transport.TLSClientConfig != nil {
-		transport.TLSClientConfig.InsecureSkipVerify = false
-		//client.Transport.TLSClientConfig = nil
+	if !s.noCookies {
+		for _, cookie := range s.Cookies {
+			req.AddCookie(cookie)
+		}
 	}
 
 	if s.MaxRedirects == -1 {
-		s.MaxRedirects = defaultOption.MaxRedirects
+		s.MaxRedirects = s.option().MaxRedirects
 	}
-	if s.MaxRedirects >= 0 {
+	// with AllowErrorBody a stopped redirect hands back the redirect response, its body still readable
+	var redirectErr error
+	if s.MaxRedirects >= 0 || s.SameHostOnly || s.RedirectFn != nil {
 		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-			if len(via) > s.MaxRedirects {
-				return errors.New("Error redirecting. MaxRedirects reached")
+			if s.MaxRedirects == 0 {
+				return http.ErrUseLastResponse
 			}
 
 			//By default Golang will not redirect request headers
@@ -830,6 +1929,36 @@ func (s *HttpAgent) End(callback ...func(response *http.Response, errs []error))
 			for key, val := range via[0].Header {
 				req.Header[key] = val
 			}
+			// credentials only follow a redirect to the same host and port
+			sameHost := strings.EqualFold(req.URL.Host, via[0].URL.Host)
+			if !sameHost {
+				for _, key := range []string{"Authorization", "Www-Authenticate", "Cookie", "Cookie2"} {
+					req.Header.Del(key)
+				}
+			}
+
+			if s.RedirectFn != nil {
+				if err := s.RedirectFn(req, via); err != nil {
+					return err
+				}
+			}
+
+			var stop error
+			if s.SameHostOnly && !sameHost {
+				stop = &RedirectHostError{Host: via[0].URL.Host, Target: req.URL.Host}
+			} else if s.MaxRedirects > 0 && len(via) > s.MaxRedirects {
+				stop = errors.New("Error redirecting. MaxRedirects reached")
+			} else if s.MaxRedirects < 0 && len(via) >= 10 {
+				// without a limit of its own, the agent keeps the 10 redirects of net/http
+				stop = errors.New("stopped after 10 redirects")
+			}
+			if stop != nil {
+				if s.ErrorBody {
+					redirectErr = &url.Error{Op: via[0].Method[:1] + strings.ToLower(via[0].Method[1:]), URL: req.URL.String(), Err: stop}
+					return http.ErrUseLastResponse
+				}
+				return stop
+			}
 			return nil
 		}
 	}
@@ -842,70 +1971,774 @@ func (s *HttpAgent) End(callback ...func(response *http.Response, errs []error))
 	//	//	timeout = true
 	//	//})
 	//}
-	client.Timeout = s.MaxTimeout
+	ctx := s.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// the earlier of Deadline and TotalTimeout bounds the request
+	deadline := s.deadline
+	if s.MaxTotalTimeout > 0 {
+		if d := time.Now().Add(s.MaxTotalTimeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	var cancel context.CancelFunc
+	if !deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	s.cancelLock.Lock()
+	s.cancel = cancel
+	s.cancelLock.Unlock()
+	sample := newRequestSample()
+	if sample != nil {
+		ctx = sample.trace(ctx)
+	}
+	req = req.WithContext(ctx)
+
+	switch {
+	case s.MaxTimeout > 0:
+		client.Timeout = s.MaxTimeout
+	case s.MaxTimeout < 0, s.streaming:
+		client.Timeout = 0
+	default:
+		client.Timeout = s.option().Timeout
+	}
+
+	if err = allowHost(req.URL.Host); err != nil {
+		cancel()
+		s.Errors = append(s.Errors, err)
+		return nil, s.Errors
+	}
 	// Send request
-	resp, err = client.Do(req)
+	resp, err = s.doRetry(client, req)
+	if sample != nil {
+		sample.log(req, s.ProxyUrl, transport, resp, err)
+	}
 	//if timer != nil {
 	//	timer.Stop()
 	//}
 
 	if err != nil {
+		// a missed deadline is reported as is, apart from a Timeout expiring
+		if ctx.Err() == context.DeadlineExceeded {
+			err = context.DeadlineExceeded
+		}
+		cancel()
 		s.Errors = append(s.Errors, err)
 		return resp, s.Errors
 	}
-	// deep copy response to give it to both return and callback func
-	respCallback := *resp
+	// the deadline covers reading the body too, release it once the body is closed
+	resp.Body = limitBody(resp.Request.URL.Host, resp.Body)
+	resp.Body = &cancelBody{resp.Body, cancel}
+	s.finalURL = resp.Request.URL.String()
+	if redirectErr != nil {
+		s.Errors = append(s.Errors, redirectErr)
+	}
 	if len(callback) != 0 {
+		// read the body once so the callback and the caller each get a reader of their own
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			s.Errors = append(s.Errors, err)
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		respCallback := *resp
+		respCallback.Body = ioutil.NopCloser(bytes.NewReader(body))
 		callback[0](&respCallback, s.Errors)
+		if err != nil {
+			return resp, s.Errors
+		}
+	}
+	if redirectErr != nil {
+		return resp, s.Errors
 	}
 	return resp, nil
 }
 
-func (s *HttpAgent) Bytes(status ...int) ([]byte, int, error) {
-	if s.Url == "" || s.Method == "" {
-		return nil, http.StatusBadRequest, errors.New("req error, need set url and method")
+// Cancel aborts the request of the current End from another goroutine, reading its body included:
+// End or the pending read returns context.Canceled. It does nothing when no request is in flight.
+//
+//      s := gohttp.New().Get("http://example.com/big.iso")
+//      time.AfterFunc(time.Minute, s.Cancel)
+//      s.WriteTo(f)
+//
+func (s *HttpAgent) Cancel() {
+	s.cancelLock.Lock()
+	defer s.cancelLock.Unlock()
+	if s.cancel != nil {
+		s.cancel()
 	}
+}
 
+// EndBytes is End reading the whole body, decoded as with Bytes, and handing it to the callback as well.
+// The body is read once, resp.Body is replaced by a reader over the same bytes.
+//
+//      gohttp.New().
+//        Get("http://example.com/").
+//        EndBytes(func(resp *http.Response, body []byte, errs []error) {
+//          fmt.Println(resp.StatusCode, len(body))
+//        })
+//
+func (s *HttpAgent) EndBytes(callback ...func(resp *http.Response, body []byte, errs []error)) (*http.Response, []byte, []error) {
+	resp, errs := s.End()
+	var body []byte
+	if errs == nil {
+		reader, err := s.decodeBody(resp)
+		if err == nil {
+			body, err = ioutil.ReadAll(reader)
+			reader.Close()
+		}
+		if err != nil {
+			s.Errors = append(s.Errors, err)
+			errs = s.Errors
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if len(callback) != 0 {
+		callback[0](resp, body, errs)
+	}
+	return resp, body, errs
+}
+
+// addFormFields appends the fields added with AddField to values.
+func addFormFields(values url.Values, fields url.Values) {
+	for key, vals := range fields {
+		for _, v := range vals {
+			values.Add(key, v)
+		}
+	}
+}
+
+// BodyString returns the body End would send, as End would serialize it, without sending anything:
+// the json, the form-encoded string, the text. Multipart and stream bodies and readers given to SetBody
+// or SendReader are summed up instead, reading them would consume them. Requests without a body give "".
+func (s *HttpAgent) BodyString() (string, error) {
+	if len(s.Errors) != 0 {
+		return "", s.Errors[0]
+	}
+	if s.Method != POST && s.Method != PUT && s.Method != PATCH {
+		return "", nil
+	}
+	if s.Body != nil {
+		return fmt.Sprintf("<%s body read from a %T>", s.ContentType, s.Body), nil
+	}
+
+	target := s.bodyType()
+	switch target {
+	case "multipart", "related":
+		return fmt.Sprintf("<%s body with %d fields and %d files>", target, len(s.Data)+len(s.FormData)+len(s.typedFields), len(s.FileData)), nil
+	case "stream":
+		data, _ := s.Data["stream"].([]byte)
+		return fmt.Sprintf("<stream body of %d bytes>", len(data)), nil
+	}
+
+	req, err := s.newRequest()
+	if err != nil {
+		return "", err
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	return string(body), err
+}
+
+// textBody returns the body of a text or xml request, the string given to Send or SendString.
+// Data sent another way, as a map or bytes, can't be sent as text and is an error.
+func (s *HttpAgent) textBody(target string) (string, error) {
+	if text, ok := s.Data["text"].(string); ok {
+		return text, nil
+	}
+	if len(s.Data) == 0 && s.DataAll == nil {
+		return "", nil
+	}
+	return "", fmt.Errorf("Type %q sends a string, call Type before Send or use SendString", target)
+}
+
+// bodyType returns the type the body is serialized as: the one forced with Type, else the one derived
+// from the data sent, turned into multipart when files were added, as a json or form body can't carry them.
+func (s *HttpAgent) bodyType() string {
+	switch s.ForceType {
+	case "json", "form", "text", "xml", "multipart", "related", "stream", "raw":
+		return s.ForceType
+	}
+	if s.ForceType == "" && len(s.FileData) > 0 && (s.TargetType == "json" || s.TargetType == "form") {
+		return "multipart"
+	}
+	return s.TargetType
+}
+
+// newRequest builds the request with its body serialized as the type of the agent says.
+func (s *HttpAgent) newRequest() (req *http.Request, err error) {
+	target := s.bodyType()
+
+	switch s.Method {
+	case POST, PUT, PATCH:
+		if s.Body != nil {
+			if req, err = http.NewRequest(s.Method, s.Url, s.Body); err != nil {
+				return nil, err
+			}
+			if s.ContentType != "" {
+				req.Header.Set("Content-Type", s.ContentType)
+			}
+			if s.BodyLength > 0 {
+				req.ContentLength = s.BodyLength
+			} else if s.BodyLength < 0 {
+				// unknown length, let the server read it chunk by chunk
+				req.ContentLength = 0
+				req.TransferEncoding = []string{"chunked"}
+			}
+		} else if target == "json" {
+			var contentJson []byte
+			if s.DataAll != nil {
+				contentJson, _ = json.Marshal(s.DataAll)
+			} else {
+				contentJson, _ = json.Marshal(s.Data)
+			}
+			contentReader := bytes.NewReader(contentJson)
+			if req, err = http.NewRequest(s.Method, s.Url, contentReader); err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", s.withCharset("application/json"))
+		} else if target == "form" {
+			formData := changeMapToURLValues(s.Data, s.arrayFormat())
+			addFormFields(formData, s.FormData)
+			if req, err = http.NewRequest(s.Method, s.Url, strings.NewReader(formData.Encode())); err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", s.withCharset("application/x-www-form-urlencoded"))
+		} else if target == "text" || target == "xml" {
+			var formdata string
+			if formdata, err = s.textBody(target); err != nil {
+				return nil, err
+			}
+			if req, err = http.NewRequest(s.Method, s.Url, strings.NewReader(formdata)); err != nil {
+				return nil, err
+			}
+			if target == "text" {
+				req.Header.Set("Content-Type", s.withCharset("text/plain"))
+			} else {
+				req.Header.Set("Content-Type", s.withCharset("text/xml"))
+			}
+		} else if target == "stream" {
+			body, ok := s.Data["stream"].([]byte)
+			if !ok && (len(s.Data) != 0 || s.DataAll != nil) {
+				return nil, errors.New("Type \"stream\" sends bytes, use SendBytes or SetBody instead of Send")
+			}
+			if req, err = http.NewRequest(s.Method, s.Url, bytes.NewReader(body)); err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/octet-stream")
+		} else if target == "raw" {
+			var body []byte
+			if data, ok := s.Data["stream"].([]byte); ok {
+				body = data
+			} else if text, ok := s.Data["text"].(string); ok {
+				body = []byte(text)
+			} else if s.DataAll != nil {
+				body, _ = json.Marshal(s.DataAll)
+			} else {
+				body, _ = json.Marshal(s.Data)
+			}
+			if req, err = http.NewRequest(s.Method, s.Url, bytes.NewReader(body)); err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", s.ContentType)
+		} else if target == "multipart" {
+
+			mw := NewMultiPartStreamer()
+			if s.Boundary != "" {
+				if err = mw.SetBoundary(s.Boundary); err != nil {
+					return nil, err
+				}
+			}
+
+			if len(s.Data) != 0 || len(s.FormData) != 0 {
+				formData := changeMapToURLValues(s.Data, s.arrayFormat())
+				addFormFields(formData, s.FormData)
+				mw.WriteFields(formData)
+			}
+			for _, field := range s.typedFields {
+				mw.WriteFieldWithType(field.name, field.value, field.ctype)
+			}
+
+			files, err := s.openFileData()
+			if err != nil {
+				return nil, err
+			}
+			if len(files) > 0 {
+				for _, file := range files {
+					mw.WriteReader(file)
+					// mw.WriteReader(file.Fieldname, file.Filename, file.Len, file.Reader)
+				}
+			}
+
+			if req, err = http.NewRequest(s.Method, s.Url, nil); err != nil {
+				return nil, err
+			}
+			mw.SetupRequest(req)
+			// req.Header.Set("Content-Type", mw.FormDataContentType())
+		} else if target == "related" {
+			mw := NewMultiPartStreamerType("related")
+			if s.Boundary != "" {
+				if err = mw.SetBoundary(s.Boundary); err != nil {
+					return nil, err
+				}
+			}
+
+			if s.DataAll != nil || len(s.Data) != 0 {
+				var metadata []byte
+				if s.DataAll != nil {
+					metadata, _ = json.Marshal(s.DataAll)
+				} else {
+					metadata, _ = json.Marshal(s.Data)
+				}
+				mw.WritePart(s.withCharset("application/json"), metadata)
+			}
+
+			files, err := s.openFileData()
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range files {
+				mw.WriteReader(file)
+			}
+
+			if req, err = http.NewRequest(s.Method, s.Url, nil); err != nil {
+				return nil, err
+			}
+			mw.SetupRequest(req)
+		}
+	case GET, HEAD, DELETE:
+		req, err = http.NewRequest(s.Method, s.Url, nil)
+	}
+	if req == nil && err == nil {
+		err = fmt.Errorf("req error, unsupported method %q", s.Method)
+	}
+	return req, err
+}
+
+// MultipartBoundary sends multipart bodies of this agent with the boundary b instead of a random one,
+// for reproducible tests or picky servers. An invalid boundary, see MultipartStreamer.SetBoundary,
+// is an error returned by End:
+//
+//      gohttp.New().
+//        MultipartBoundary("gohttp-boundary").
+//        Post("http://example.com/upload").
+//        SendFile("./report.pdf").
+//        End()
+//
+func (s *HttpAgent) MultipartBoundary(b string) *HttpAgent {
+	s.Boundary = b
+	return s
+}
+
+// keepBoundary returns the Content-Type set by the user, unless the body is multipart:
+// the body's boundary is then kept, in the user's multipart type if there is one.
+func keepBoundary(user string, body string) string {
+	_, params, err := mime.ParseMediaType(body)
+	if err != nil || params["boundary"] == "" {
+		return user
+	}
+	mt, userParams, err := mime.ParseMediaType(user)
+	if err != nil || !strings.HasPrefix(mt, "multipart/") {
+		return body
+	}
+	userParams["boundary"] = params["boundary"]
+	return mime.FormatMediaType(mt, userParams)
+}
+
+// cancelBody cancels the request context when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// FinalURL returns the url the last request ended up at after following redirects, "" before it is sent.
+// It works with the String, Bytes or ToJSON helpers too, which don't hand out the response.
+func (s *HttpAgent) FinalURL() string {
+	return s.finalURL
+}
+
+// bodyReader reads a decoded response body, closing it closes the decoder and the body.
+type bodyReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *bodyReader) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// openBody runs End, checks the status and returns the response together with a reader of the decoded body.
+// On success the caller must close the reader.
+func (s *HttpAgent) openBody(status ...int) (*http.Response, io.ReadCloser, int, error) {
+	return s.open(false, status)
+}
+
+// openStream is openBody for the helpers streaming the body, which run without Option.Timeout.
+func (s *HttpAgent) openStream(status ...int) (*http.Response, io.ReadCloser, int, error) {
+	s.streaming = true
+	defer func() { s.streaming = false }()
+	return s.openBody(status...)
+}
+
+// open is openBody, with soft it also returns the body of a response End reported a soft error for,
+// along with that error. See AllowErrorBody.
+func (s *HttpAgent) open(soft bool, status []int) (*http.Response, io.ReadCloser, int, error) {
+	resp, code, err := s.end(soft, status)
+	if resp == nil {
+		return nil, nil, code, err
+	}
+	reader, derr := s.decodeBody(resp)
+	if derr != nil {
+		return nil, nil, code, derr
+	}
+	return resp, reader, code, err
+}
+
+// endStatus runs End and checks the status of the response is one of status.
+func (s *HttpAgent) endStatus(status ...int) (*http.Response, int, error) {
+	return s.end(false, status)
+}
+
+// end is endStatus, with soft it keeps the response End returned with a soft error.
+func (s *HttpAgent) end(soft bool, status []int) (*http.Response, int, error) {
+	if s.Url == "" || s.Method == "" {
+		return nil, http.StatusBadRequest, errors.New("req error, need set url and method")
+	}
+
+	var softErr error
 	resp, errs := s.End()
 	if errs != nil {
-		return nil, http.StatusBadRequest, errs[0]
+		if !soft || !s.ErrorBody || resp == nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, http.StatusBadRequest, errs[0]
+		}
+		softErr = errs[0]
 	}
-	defer resp.Body.Close()
 	if status != nil {
-		found := false
-		for _, val := range status {
-			if resp.StatusCode == val {
-				found = true
-				break
-			}
+		found := statusIn(resp.StatusCode, status)
+		// partial content is what a Range request asks for
+		if _, ok := s.requestHeader["Range"]; ok && resp.StatusCode == http.StatusPartialContent {
+			found = true
+		}
+		// and not modified is a valid answer to a conditional request
+		if s.isConditional() && resp.StatusCode == http.StatusNotModified {
+			found = true
 		}
 		if !found {
 			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
 			return nil, resp.StatusCode, errors.New(fmt.Sprintf("status not match we want!, statuscode = %d", resp.StatusCode))
 		}
 	}
+	return resp, resp.StatusCode, softErr
+}
+
+// decodeBody returns a reader of the decoded body of resp, closing it closes the body.
+// Stacked encodings like "gzip, br" are undone in reverse order, an unknown one is an error.
+func (s *HttpAgent) decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	if s.RawResponse {
+		return resp.Body, nil
+	}
+	encodings := contentEncodings(resp.Header)
+	if len(encodings) == 0 {
+		return resp.Body, nil
+	}
 
-	if resp.Header.Get("Content-Encoding") == "gzip" {
-		reader, err := gzip.NewReader(resp.Body)
+	var reader io.Reader = resp.Body
+	closers := []io.Closer{resp.Body}
+	// the last encoding listed was applied last
+	for i := len(encodings) - 1; i >= 0; i-- {
+		r, err := decodeReader(encodings[i], reader)
 		if err != nil {
-			return nil, resp.StatusCode, err
+			resp.Body.Close()
+			return nil, err
+		}
+		if c, ok := r.(io.Closer); ok {
+			closers = append([]io.Closer{c}, closers...)
 		}
-		body, err := ioutil.ReadAll(reader)
-		return body, resp.StatusCode, err
+		reader = r
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	return body, resp.StatusCode, err
+	return &bodyReader{reader, closers}, nil
+}
+
+// compressBody replaces the body of req by its compressed version.
+func compressBody(req *http.Request, encoding string) error {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	default:
+		return fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+	_, err := io.Copy(w, req.Body)
+	req.Body.Close()
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	body := buf.Bytes()
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Header.Set("Content-Encoding", encoding)
+	return nil
+}
+
+// contentEncodings lists the encodings of the Content-Encoding header, identity left out.
+func contentEncodings(h http.Header) []string {
+	var encodings []string
+	for _, v := range h.Values("Content-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			enc = strings.ToLower(strings.TrimSpace(enc))
+			if enc != "" && enc != "identity" {
+				encodings = append(encodings, enc)
+			}
+		}
+	}
+	return encodings
+}
+
+func decodeReader(encoding string, r io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return zlib.NewReader(r)
+	case "br":
+		return brotli.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+}
+
+// Bytes sends the request and returns the response body with its status code.
+// By default the transport asks for gzip and decompresses it transparently. When Accept-Encoding
+// is set explicitly with Set, the transport leaves the body alone and it is decoded here instead:
+// gzip, deflate and br, stacked ones like "gzip, br" included.
+// With RawBody the body is returned exactly as received.
+func (s *HttpAgent) Bytes(status ...int) ([]byte, int, error) {
+	cache, key := getCache(), ""
+	if cache != nil {
+		key = s.cacheKey()
+	}
+	if key != "" {
+		if entry, ok := cache.get(key, s.cacheHeader); ok && (status == nil || statusIn(entry.code, status)) {
+			s.cached = true
+			s.sent = true
+			return entry.body, entry.code, nil
+		}
+	}
+
+	resp, reader, code, err := s.open(true, status)
+	if reader == nil {
+		return nil, code, err
+	}
+	defer reader.Close()
+
+	body, rerr := ioutil.ReadAll(reader)
+	if rerr != nil {
+		return body, code, rerr
+	}
+	if err == nil && key != "" && code == http.StatusOK && !s.RawResponse {
+		expires, ok := cacheExpires(resp.Header)
+		vary, varyOk := cacheVary(resp)
+		// cookies the jar picked up on the way, from a redirect, make the response private too
+		if ok && varyOk && resp.Request.Header.Get("Authorization") == "" && resp.Request.Header.Get("Cookie") == "" {
+			cache.put(key, code, body, expires, vary)
+		}
+	}
+	return body, code, err
+}
+
+// BytesHeaders is Bytes also returning a copy of the response headers, for a Location or a rate limit header
+// that comes along with the body:
+//
+//      body, header, code, err := gohttp.New().
+//        Post("http://example.com/hooks").
+//        Send(event).
+//        BytesHeaders(http.StatusCreated)
+//
+// The response cache of Bytes is not used.
+func (s *HttpAgent) BytesHeaders(status ...int) ([]byte, http.Header, int, error) {
+	resp, reader, code, err := s.openBody(status...)
+	if err != nil {
+		return nil, nil, code, err
+	}
+	defer reader.Close()
+
+	body, err := ioutil.ReadAll(reader)
+	return body, resp.Header.Clone(), code, err
+}
+
+// ResponseInfo describes a response read by BytesInfo.
+type ResponseInfo struct {
+	StatusCode int
+	// ContentEncoding is the Content-Encoding the body was sent with, "" when not encoded
+	ContentEncoding string
+	// CompressedSize is the size of the body on the wire
+	CompressedSize int64
+	// DecompressedSize is the size of the decoded body
+	DecompressedSize int64
+	FinalURL         string
+}
+
+// BytesInfo is Bytes also reporting how the body was transferred, like its encoding and its size
+// before and after decompression, to measure bandwidth savings.
+// It asks for gzip itself so the compressed size can be counted, unless Accept-Encoding is set.
+func (s *HttpAgent) BytesInfo(status ...int) ([]byte, ResponseInfo, error) {
+	if _, ok := s.Header["Accept-Encoding"]; !ok && !s.RawResponse {
+		s.setRequestHeader("Accept-Encoding", "gzip")
+	}
+
+	resp, code, err := s.endStatus(status...)
+	info := ResponseInfo{StatusCode: code}
+	if err != nil {
+		return nil, info, err
+	}
+	info.FinalURL = s.finalURL
+	info.ContentEncoding = resp.Header.Get("Content-Encoding")
+
+	counter := &countReader{r: resp.Body}
+	resp.Body = &bodyReader{counter, []io.Closer{resp.Body}}
+	reader, err := s.decodeBody(resp)
+	if err != nil {
+		return nil, info, err
+	}
+	defer reader.Close()
+
+	body, err := ioutil.ReadAll(reader)
+	info.CompressedSize = counter.n
+	info.DecompressedSize = int64(len(body))
+	return body, info, err
+}
+
+// countReader counts the bytes read through it.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func statusIn(code int, status []int) bool {
+	for _, val := range status {
+		if code == val {
+			return true
+		}
+	}
+	return false
+}
+
+// Exists sends the request as HEAD and reports whether the status is 2xx, along with the Content-Length
+// (-1 when the server doesn't tell). A handy preflight before downloading:
+//
+//      ok, size, err := gohttp.New().Head("http://example.com/big.iso").Exists()
+//
+// Headers and query of the agent are kept, the body and its type are dropped, a HEAD has none.
+func (s *HttpAgent) Exists() (bool, int64, error) {
+	if s.Url == "" {
+		return false, -1, errors.New("req error, need set url")
+	}
+	s.Method = HEAD
+	s.clearBody()
+
+	resp, errs := s.End()
+	if errs != nil {
+		return false, -1, errs[0]
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 300, resp.ContentLength, nil
+}
+
+// WriteTo sends the request and copies the decoded response body into w without buffering it,
+// returning the number of bytes written and the status code:
+//
+//      h := sha256.New()
+//      n, code, err := gohttp.New().
+//        Get("http://example.com/big.iso").
+//        WriteTo(h, http.StatusOK)
+//
+func (s *HttpAgent) WriteTo(w io.Writer, status ...int) (int64, int, error) {
+	_, reader, code, err := s.openStream(status...)
+	if err != nil {
+		return 0, code, err
+	}
+	defer reader.Close()
+
+	n, err := io.Copy(w, reader)
+	return n, code, err
 }
 
 func (s *HttpAgent) String(status ...int) (string, int, error) {
 	body, code, err := s.Bytes(status...)
-	if err != nil {
+	if err != nil && !s.ErrorBody {
 		return "", code, err
 	}
 
 	return string(body), code, err
 }
 
+// StringCharset returns the body transcoded to UTF-8 from enc, like "gbk" or "shift_jis".
+// An empty enc takes the charset of the response Content-Type. The body is returned untouched
+// when the charset is unknown or already UTF-8:
+//
+//      body, _, err := gohttp.New().
+//        Get("http://www.example.cn/").
+//        StringCharset("gbk")
+//
+func (s *HttpAgent) StringCharset(enc string, status ...int) (string, int, error) {
+	resp, reader, code, err := s.openBody(status...)
+	if err != nil {
+		return "", code, err
+	}
+	defer reader.Close()
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", code, err
+	}
+	if enc == "" {
+		if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+			enc = params["charset"]
+		}
+	}
+	if e, err := htmlindex.Get(enc); err == nil && e != encoding.Nop && e != unicode.UTF8 {
+		if decoded, err := e.NewDecoder().Bytes(body); err == nil {
+			body = decoded
+		}
+	}
+	return string(body), code, nil
+}
+
 func (s *HttpAgent) ToJSON(v interface{}, status ...int) (int, error) {
 	body, code, err := s.Bytes(status...)
 	if err != nil {
@@ -916,6 +2749,157 @@ func (s *HttpAgent) ToJSON(v interface{}, status ...int) (int, error) {
 	return code, err
 }
 
+// ToValue decodes the JSON body and returns the value found at a dotted path, array elements being
+// picked by index. Numbers come back as json.Number. An empty path returns the whole document.
+//
+//      name, _, err := gohttp.New().
+//        Get("http://example.com/api/items").
+//        ToValue("data.items.0.name")
+//
+func (s *HttpAgent) ToValue(path string, status ...int) (interface{}, int, error) {
+	var v interface{}
+	code, err := s.ToJSON(&v, status...)
+	if err != nil {
+		return nil, code, err
+	}
+	v, err = lookupPath(v, path)
+	return v, code, err
+}
+
+// lookupPath walks a dotted path through decoded JSON.
+func lookupPath(v interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return v, nil
+	}
+	for i, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			val, ok := node[key]
+			if !ok {
+				return nil, fmt.Errorf("ToValue: no key %q at %q", key, walkedPath(path, i))
+			}
+			v = val
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return nil, fmt.Errorf("ToValue: no index %q at %q, array has %d elements", key, walkedPath(path, i), len(node))
+			}
+			v = node[idx]
+		default:
+			return nil, fmt.Errorf("ToValue: %q is not an object or array, can't look up %q", walkedPath(path, i), key)
+		}
+	}
+	return v, nil
+}
+
+// walkedPath returns the first n segments of path, or "." for the root.
+func walkedPath(path string, n int) string {
+	if n == 0 {
+		return "."
+	}
+	return strings.Join(strings.Split(path, ".")[:n], ".")
+}
+
+// ToJSONLines decodes a newline-delimited JSON (JSON lines) response one object at a time, calling fn for each.
+// The body is streamed rather than buffered, so it suits long-running event feeds. Decoding stops at the first error returned by fn.
+//
+//      code, err := gohttp.New().
+//        Get("http://example.com/events").
+//        ToJSONLines(func(line json.RawMessage) error {
+//          fmt.Println(string(line))
+//          return nil
+//        }, http.StatusOK)
+//
+func (s *HttpAgent) ToJSONLines(fn func(json.RawMessage) error, status ...int) (int, error) {
+	_, reader, code, err := s.openStream(status...)
+	if err != nil {
+		return code, err
+	}
+	defer reader.Close()
+
+	d := json.NewDecoder(reader)
+	for {
+		var line json.RawMessage
+		if err := d.Decode(&line); err == io.EOF {
+			return code, nil
+		} else if err != nil {
+			return code, err
+		}
+		if err := fn(line); err != nil {
+			return code, err
+		}
+	}
+}
+
+// EventStream consumes a Server-Sent Events response, calling fn for each event until the stream
+// closes, fn returns an error or the context set by WithContext is done.
+// The event name is "message" when the server sends none, and multiple data lines are joined with "\n".
+//
+//      ctx, cancel := context.WithCancel(context.Background())
+//      err := gohttp.New().
+//        Get("http://example.com/stream").
+//        WithContext(ctx).
+//        EventStream(func(event, data string) error {
+//          fmt.Println(event, data)
+//          return nil
+//        })
+//
+func (s *HttpAgent) EventStream(fn func(event, data string) error) error {
+	if _, ok := s.Header["Accept"]; !ok {
+		s.setRequestHeader("Accept", "text/event-stream")
+	}
+
+	_, reader, _, err := s.openStream(http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var (
+		event string
+		data  []string
+	)
+	br := bufio.NewReader(reader)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			// blank line dispatches the event
+			if len(data) > 0 {
+				if event == "" {
+					event = "message"
+				}
+				if err := fn(event, strings.Join(data, "\n")); err != nil {
+					return err
+				}
+			}
+			event, data = "", nil
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
+
 func (s *HttpAgent) ToXML(v interface{}, status ...int) (int, error) {
 	body, code, err := s.Bytes(status...)
 	if err != nil {
@@ -926,6 +2910,33 @@ func (s *HttpAgent) ToXML(v interface{}, status ...int) (int, error) {
 	return code, err
 }
 
+// ToStruct decodes the body into v as XML when the response Content-Type is XML (application/xml, text/xml
+// or a +xml type), as JSON otherwise. It suits content-negotiated APIs answering in either format.
+func (s *HttpAgent) ToStruct(v interface{}, status ...int) (int, error) {
+	resp, reader, code, err := s.openBody(status...)
+	if err != nil {
+		return code, err
+	}
+	defer reader.Close()
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return code, err
+	}
+	if isXMLType(resp.Header.Get("Content-Type")) {
+		return code, xml.Unmarshal(body, v)
+	}
+	return code, json_unmarshal(body, v)
+}
+
+func isXMLType(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == "application/xml" || mt == "text/xml" || strings.HasSuffix(mt, "+xml")
+}
+
 func json_unmarshal(body []byte, v interface{}) error {
 	d := json.NewDecoder(bytes.NewBuffer(body))
 	d.UseNumber()
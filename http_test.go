@@ -1,13 +1,42 @@
 package gohttp
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/brotli"
 )
 
 func TestGoHttp(t *testing.T) {
@@ -26,6 +55,103 @@ func TestGoHttp(t *testing.T) {
 	log.Println(string(body))
 }
 
+func TestArrayFormats(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		q, _ := url.QueryUnescape(r.URL.RawQuery)
+		form, _ := url.QueryUnescape(string(body))
+		fmt.Fprintf(w, "%s|%s", q, form)
+	}))
+	defer ts.Close()
+
+	for _, c := range []struct{ format, want string }{
+		{"", "id[]=1&id[]=2"},
+		{ArrayBrackets, "id[]=1&id[]=2"},
+		{ArrayRepeat, "id=1&id=2"},
+		{ArrayComma, "id=1,2"},
+	} {
+		s := New().Post(ts.URL)
+		if c.format != "" {
+			s.ArrayFormat(c.format)
+		}
+		body, _, err := s.
+			Query(map[string]interface{}{"id": []int{1, 2}}).
+			Type("form").
+			Send(map[string]interface{}{"id": []int{1, 2}}).
+			String()
+		if want := c.want + "|" + c.want; err != nil || body != want {
+			t.Errorf("format %q: query|form = %q, err = %v, want %q", c.format, body, err, want)
+		}
+	}
+
+	if s := New().ArrayFormat("indices"); s.Errors == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+// testCertPEM returns a self-signed certificate and its key, PEM encoded.
+func testCertPEM(t *testing.T) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestClientCertMerge(t *testing.T) {
+	certPEM, keyPEM := testCertPEM(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, certPEM, 0600)
+	ioutil.WriteFile(keyFile, keyPEM, 0600)
+
+	roots := x509.NewCertPool()
+	shared := &tls.Config{RootCAs: roots, InsecureSkipVerify: true, ServerName: "api.example.com"}
+	s := New().TLSClientConfig(shared).ClientCert(certFile, keyFile)
+	if s.Errors != nil {
+		t.Fatal(s.Errors)
+	}
+	config := s.TlsConfig
+	if len(config.Certificates) != 1 {
+		t.Fatalf("%d certificates, want 1", len(config.Certificates))
+	}
+	if config.RootCAs != roots || !config.InsecureSkipVerify || config.ServerName != "api.example.com" {
+		t.Errorf("settings of the TLS config lost: %+v", config)
+	}
+	if len(shared.Certificates) != 0 {
+		t.Error("config given to TLSClientConfig modified")
+	}
+
+	// a second certificate is added, not replacing the first
+	if s.ClientCertPEM(certPEM, keyPEM); len(s.TlsConfig.Certificates) != 2 {
+		t.Errorf("%d certificates, want 2", len(s.TlsConfig.Certificates))
+	}
+
+	// without a config one is created
+	if s := New().ClientCert(certFile, keyFile); s.Errors != nil || len(s.TlsConfig.Certificates) != 1 {
+		t.Errorf("no config: errors %v", s.Errors)
+	}
+	if s := New().ClientCert(certFile, certFile); s.Errors == nil {
+		t.Error("no error for a bad key file")
+	}
+}
+
 func TestQuery(t *testing.T) {
 
 	SetOption(&Option{
@@ -48,3 +174,2576 @@ func TestQuery(t *testing.T) {
 	fmt.Println(doc.Find(".result h3 a").Text())
 	fmt.Println(doc.Find("#page").Html())
 }
+
+func TestSetDialerKeepsGetter(t *testing.T) {
+	before := GetDefaultGetter()
+	SetDialer(&net.Dialer{KeepAlive: time.Minute})
+	defer SetDialer(nil)
+	if GetDefaultGetter() != before {
+		t.Error("SetDialer replaced the client getter")
+	}
+
+	roll := NewIpRollClient("127.0.0.1")
+	client, err := roll.GetHttpClient("http://example.com/", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := url.Parse("http://example.com/")
+	client.Jar.SetCookies(uri, []*http.Cookie{{Name: "session", Value: "1"}})
+	roll.rebuildTransports()
+	rebuilt, _ := roll.GetHttpClient("http://example.com/", "", true)
+	if rebuilt.Transport == client.Transport {
+		t.Error("transport not rebuilt")
+	}
+	if len(rebuilt.Jar.Cookies(uri)) != 1 {
+		t.Error("cookie jar of the ip lost")
+	}
+}
+
+func TestNoProxy(t *testing.T) {
+	// http.ProxyFromEnvironment reads the environment once, setting HTTP_PROXY here would prove nothing
+	base := GetDefaultTransport().Clone()
+	base.Proxy = http.ProxyFromEnvironment
+
+	if transport := New().NoProxy().agentTransport(base); transport == base || transport.Proxy != nil {
+		t.Error("NoProxy kept the proxy of the environment")
+	}
+
+	proxy, _ := url.Parse("http://127.0.0.1:1")
+	transport := New().NoProxy().ProxyFunc(http.ProxyURL(proxy)).agentTransport(base)
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if got, _ := transport.Proxy(req); got == nil || got.Host != "127.0.0.1:1" {
+		t.Errorf("proxy of ProxyFunc = %v", got)
+	}
+}
+
+func TestHost(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Host, r.TLS.ServerName)
+	}))
+	defer ts.Close()
+
+	// the test certificate is valid for example.com
+	config := &tls.Config{RootCAs: ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+	s := New().TLSClientConfig(config).Host("example.com")
+	body, _, err := s.Get(ts.URL).String()
+	if err != nil || body != "example.com example.com" {
+		t.Errorf("body = %q, err = %v", body, err)
+	}
+	if config.ServerName != "" || s.TlsConfig.ServerName != "" {
+		t.Error("Host changed the TLS config of the agent")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer ts.Close()
+
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	body, _, err := New().Resolve("gohttp.invalid", "127.0.0.1").Get("http://gohttp.invalid:" + port + "/").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "gohttp.invalid:"+port {
+		t.Errorf("host = %q", body)
+	}
+}
+
+func TestToJSONLines(t *testing.T) {
+	// the first line is decoded while the server waits, before the stream ends
+	first := make(chan struct{}, 1)
+	var ended int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		for n := 1; n <= 3; n++ {
+			fmt.Fprintf(zw, "{\"n\":%d}\n", n)
+			zw.Flush()
+			w.(http.Flusher).Flush()
+			if n == 1 {
+				select {
+				case <-first:
+				case <-time.After(2 * time.Second):
+				}
+			}
+		}
+		zw.Close()
+		atomic.StoreInt32(&ended, 1)
+	}))
+	defer ts.Close()
+
+	var got []int
+	decode := func(line json.RawMessage) int {
+		var v struct{ N int }
+		if err := json.Unmarshal(line, &v); err != nil {
+			t.Errorf("line %q: %v", line, err)
+		}
+		got = append(got, v.N)
+		if v.N == 1 {
+			if atomic.LoadInt32(&ended) != 0 {
+				t.Error("first line decoded only after the stream ended")
+			}
+			first <- struct{}{}
+		}
+		return v.N
+	}
+
+	code, err := New().Get(ts.URL).Set("Accept-Encoding", "gzip").ToJSONLines(func(line json.RawMessage) error {
+		decode(line)
+		return nil
+	}, http.StatusOK)
+	if err != nil || code != http.StatusOK || fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("lines = %v, code = %d, err = %v", got, code, err)
+	}
+
+	// an error from fn stops decoding and is returned
+	got = nil
+	atomic.StoreInt32(&ended, 0)
+	stop := errors.New("stop")
+	_, err = New().Get(ts.URL).Set("Accept-Encoding", "gzip").ToJSONLines(func(line json.RawMessage) error {
+		if decode(line) == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || fmt.Sprint(got) != "[1 2]" {
+		t.Errorf("lines = %v, err = %v, want stop after 2", got, err)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "text/event-stream" {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		io.WriteString(w, ": comment\n\ndata: line one\ndata: line two\n\nevent: update\ndata: {\"a\":1}\n\n")
+		if r.URL.Query().Get("hold") == "" {
+			return
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	var got []string
+	err := New().Get(ts.URL).EventStream(func(event, data string) error {
+		got = append(got, event+"="+data)
+		return nil
+	})
+	want := []string{"message=line one\nline two", `update={"a":1}`}
+	if err != nil || strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("events = %q, err = %v, want %q", got, err, want)
+	}
+
+	// the stream stays open until the context is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- New().Get(ts.URL).Param("hold", "1").WithContext(ctx).EventStream(func(event, data string) error {
+			if event == "update" {
+				cancel()
+			}
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("canceled stream ended without error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("EventStream still running after cancel")
+	}
+}
+
+func TestRedirectKeepsBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusTemporaryRedirect)
+			return
+		}
+		if r.Method != POST {
+			t.Errorf("method = %s", r.Method)
+		}
+		if err := r.ParseMultipartForm(1 << 20); err == nil {
+			w.Write([]byte(r.FormValue("name")))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	body, _, err := New().Post(ts.URL + "/old").Send(`{"name":"gohttp"}`).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != `{"name":"gohttp"}` {
+		t.Errorf("json body = %q", body)
+	}
+
+	body, _, err = New().Post(ts.URL+"/old").Type("multipart").SendParam("name", "gohttp").SendFile([]byte("content")).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "gohttp" {
+		t.Errorf("multipart body = %q", body)
+	}
+}
+
+func TestWriteFieldsOrder(t *testing.T) {
+	m := NewMultiPartStreamer()
+	if err := m.WriteFields(url.Values{"b": {"2", "3"}, "c": {"4"}, "a": {"1"}}); err != nil {
+		t.Fatal(err)
+	}
+	_, params, _ := mime.ParseMediaType(m.ContentType)
+	mr := multipart.NewReader(m.GetReader(), params["boundary"])
+	var got []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		value, _ := ioutil.ReadAll(p)
+		got = append(got, p.FormName()+"="+string(value))
+	}
+	if strings.Join(got, "&") != "a=1&b=2&b=3&c=4" {
+		t.Errorf("fields = %v, want sorted by key, values in order", got)
+	}
+}
+
+func TestRange(t *testing.T) {
+	content := "0123456789abcdef"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.txt", time.Time{}, strings.NewReader(content))
+	}))
+	defer ts.Close()
+
+	body, code, err := New().Get(ts.URL).Range(4, 9).String(http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusPartialContent || body != content[4:10] {
+		t.Errorf("code = %d, body = %q", code, body)
+	}
+
+	body, _, err = New().Get(ts.URL).Range(10, -1).String(http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != content[10:] {
+		t.Errorf("open ended body = %q", body)
+	}
+}
+
+func TestRequestSettingsBeforeVerb(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s", r.Header.Get("Range"), r.Header.Get("Idempotency-Key"))
+	}))
+	defer ts.Close()
+
+	s := New()
+	body, _, err := s.Range(0, 3).IdempotencyKey("k1").Get(ts.URL).String()
+	if err != nil || body != "bytes=0-3|k1" {
+		t.Errorf("set before the verb: body = %q, err = %v", body, err)
+	}
+	if body, _, _ = s.Get(ts.URL).String(); body != "|" {
+		t.Errorf("kept after the request was sent: body = %q", body)
+	}
+	if body, _, _ = s.IdempotencyKey("k2").Get(ts.URL).String(); body != "|k2" {
+		t.Errorf("set before the verb of a reused agent: body = %q", body)
+	}
+
+	// an agent built without New
+	literal := &HttpAgent{}
+	if body, _, err = literal.Range(2, -1).RequestID().Get(ts.URL).String(); err != nil || body != "bytes=2-|" {
+		t.Errorf("literal agent: body = %q, err = %v", body, err)
+	}
+	if literal.GetRequestID() == "" {
+		t.Error("request id lost")
+	}
+}
+
+func TestHostCircuitWindow(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	host := strings.TrimPrefix(ts.URL, "http://")
+	SetHostCircuit(host, 2, 50*time.Millisecond, time.Hour)
+	defer SetHostCircuit(host, 0, 0, 0)
+
+	// failures further apart than the window never open the circuit
+	for i := 0; i < 3; i++ {
+		if _, errs := New().Get(ts.URL).End(); errs != nil {
+			t.Fatalf("request %d: %v", i, errs)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&hits); n != 3 {
+		t.Errorf("hits = %d", n)
+	}
+}
+
+// errWriter fails every write.
+type errWriter struct{ err error }
+
+func (w errWriter) Write(p []byte) (int, error) { return 0, w.err }
+
+func TestWriteToGzip(t *testing.T) {
+	closed := make(chan bool, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte("first\n"))
+		zw.Flush()
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/hold" {
+			// only a closed body frees the connection before the stream ends
+			select {
+			case <-r.Context().Done():
+				closed <- true
+			case <-time.After(2 * time.Second):
+				closed <- false
+			}
+			return
+		}
+		zw.Write([]byte("second\n"))
+		zw.Close()
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	n, code, err := New().Get(ts.URL).Set("Accept-Encoding", "gzip").WriteTo(&buf, http.StatusOK)
+	if err != nil || code != http.StatusOK || buf.String() != "first\nsecond\n" || n != int64(buf.Len()) {
+		t.Errorf("WriteTo = %q, %d bytes, code %d, err %v", buf.String(), n, code, err)
+	}
+
+	failed := errors.New("disk full")
+	if _, _, err := New().Get(ts.URL+"/hold").Set("Accept-Encoding", "gzip").WriteTo(errWriter{failed}); err != failed {
+		t.Errorf("err = %v, want the writer error", err)
+	}
+	if !<-closed {
+		t.Error("body not closed after a failed WriteTo")
+	}
+}
+
+func TestConditionalRequest(t *testing.T) {
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "feed.json", modified, strings.NewReader(`{"v":1}`))
+	}))
+	defer ts.Close()
+
+	resp, errs := New().Get(ts.URL).End()
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	since, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, code, err := New().Get(ts.URL).IfNoneMatch(etag).Bytes(http.StatusOK)
+	if err != nil || code != http.StatusNotModified || len(body) != 0 {
+		t.Errorf("IfNoneMatch: body = %q, code = %d, err = %v", body, code, err)
+	}
+	body, code, err = New().Get(ts.URL).IfModifiedSince(since).Bytes(http.StatusOK)
+	if err != nil || code != http.StatusNotModified || len(body) != 0 {
+		t.Errorf("IfModifiedSince: body = %q, code = %d, err = %v", body, code, err)
+	}
+
+	// a stale copy gets the new body
+	body, code, err = New().Get(ts.URL).IfNoneMatch(`"v0"`).Bytes(http.StatusOK)
+	if err != nil || code != http.StatusOK || string(body) != `{"v":1}` {
+		t.Errorf("stale etag: body = %q, code = %d, err = %v", body, code, err)
+	}
+	body, code, _ = New().Get(ts.URL).IfModifiedSince(since.Add(-time.Hour)).Bytes(http.StatusOK)
+	if code != http.StatusOK || string(body) != `{"v":1}` {
+		t.Errorf("stale date: body = %q, code = %d", body, code)
+	}
+
+	// without a condition a 304 is not a success
+	if _, _, err := New().Get(ts.URL).Set("If-None-Match", etag).Bytes(http.StatusOK); err == nil {
+		t.Error("304 accepted for an unconditional request")
+	}
+}
+
+func TestSetBeforeVerb(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _ := r.Cookie("sid")
+		fmt.Fprintf(w, "%s %s|%s", r.Method, r.Header.Get("X-Token"), c)
+	}))
+	defer ts.Close()
+
+	s := New().Set("X-Token", "t1").AddCookie(&http.Cookie{Name: "sid", Value: "c1"})
+	body, _, err := s.Get(ts.URL).String()
+	if err != nil || body != "GET t1|sid=c1" {
+		t.Errorf("set before the verb: body = %q, err = %v", body, err)
+	}
+	// headers and cookies belong to the agent, the next requests send them too
+	if body, _, _ = s.Post(ts.URL).String(); body != "POST t1|sid=c1" {
+		t.Errorf("reused agent: body = %q", body)
+	}
+}
+
+func TestRawBody(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("hello gzip"))
+	zw.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			http.Error(w, "want gzip", http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gz.Bytes())
+	}))
+	defer ts.Close()
+
+	body, _, err := New().Get(ts.URL).Bytes()
+	if err != nil || string(body) != "hello gzip" {
+		t.Errorf("decoded: body = %q, err = %v", body, err)
+	}
+
+	body, _, err = New().RawBody().Get(ts.URL).Bytes()
+	if err != nil || !bytes.Equal(body, gz.Bytes()) {
+		t.Errorf("raw: body = %q, err = %v, want the gzip bytes as received", body, err)
+	}
+}
+
+func TestMultipartRelated(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mt, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%s type=%s\n", mt, params["type"])
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data, _ := ioutil.ReadAll(p)
+			fmt.Fprintf(w, "%s|%s|%s\n", p.Header.Get("Content-Type"), p.Header.Get("Content-Disposition"), data)
+		}
+	}))
+	defer ts.Close()
+
+	body, _, err := New().
+		Post(ts.URL).
+		Type("related").
+		Send(map[string]interface{}{"name": "photo"}).
+		SendFile([]byte("png data"), "photo.png", "", "image/png").
+		String()
+	want := "multipart/related type=application/json\n" +
+		"application/json; charset=UTF-8||{\"name\":\"photo\"}\n" +
+		"image/png||png data\n"
+	if err != nil || body != want {
+		t.Errorf("body = %q, err = %v, want %q", body, err, want)
+	}
+
+	// without metadata the file is the root
+	body, _, _ = New().Post(ts.URL).Type("related").SendFile([]byte("png data"), "photo.png", "", "image/png").String()
+	if !strings.HasPrefix(body, "multipart/related type=image/png\n") {
+		t.Errorf("file only: body = %q", body)
+	}
+}
+
+func TestHostCircuit(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	host := strings.TrimPrefix(ts.URL, "http://")
+	SetHostCircuit(host, 2, time.Minute, time.Hour)
+	defer SetHostCircuit(host, 0, 0, 0)
+
+	for i := 0; i < 3; i++ {
+		New().Get(ts.URL).End()
+	}
+	SetHostDelay(host, time.Second)
+	defer SetHostDelay(host, 0)
+	start := time.Now()
+	_, errs := New().Get(ts.URL).End()
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("hits = %d", n)
+	}
+	if len(errs) == 0 {
+		t.Fatal("expected circuit open error")
+	}
+	if _, ok := errs[0].(*CircuitOpenError); !ok {
+		t.Errorf("err = %v", errs[0])
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("open circuit failed after %v, waited for the host delay", d)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	reused := false
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			reused = info.Reused
+		},
+	}
+	ctx := httptrace.WithClientTrace(context.Background(), trace)
+
+	req := NewSingle().KeepAlive(2).WithContext(ctx)
+	for i := 0; i < 2; i++ {
+		if _, _, err := req.Get(ts.URL).Bytes(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reused {
+		t.Error("second request did not reuse the connection")
+	}
+}
+
+func TestSetProxyFuncKeepsGetter(t *testing.T) {
+	before := GetDefaultGetter()
+	proxy, _ := url.Parse("http://127.0.0.1:1")
+	SetProxyFunc(http.ProxyURL(proxy))
+	defer SetProxyFunc(nil)
+	if GetDefaultGetter() != before {
+		t.Error("SetProxyFunc replaced the client getter")
+	}
+
+	transport := GetDefaultTransport()
+	if transport.Proxy == nil {
+		t.Fatal("proxy not installed")
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if got, _ := transport.Proxy(req); got == nil || got.Host != "127.0.0.1:1" {
+		t.Errorf("proxy = %v", got)
+	}
+}
+
+func TestMaxRedirect(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/r/"))
+		if n > 0 {
+			http.Redirect(w, r, fmt.Sprintf("/r/%d", n-1), http.StatusFound)
+			return
+		}
+		w.Write([]byte("done"))
+	}))
+	defer ts.Close()
+
+	resp, errs := New().Get(ts.URL + "/r/3").MaxRedirect(0).End()
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("MaxRedirect(0) status = %d", resp.StatusCode)
+	}
+
+	for _, max := range []int{1, 3} {
+		if _, errs := New().Get(fmt.Sprintf("%s/r/%d", ts.URL, max)).MaxRedirect(max).End(); errs != nil {
+			t.Errorf("MaxRedirect(%d) with %d redirects: %v", max, max, errs)
+		}
+		if _, errs := New().Get(fmt.Sprintf("%s/r/%d", ts.URL, max+1)).MaxRedirect(max).End(); errs == nil {
+			t.Errorf("MaxRedirect(%d) with %d redirects: expected error", max, max+1)
+		}
+	}
+}
+
+func TestRequestIDHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s", r.Header.Get("Idempotency-Key"), r.Header.Get("X-Request-Id"))
+	}))
+	defer ts.Close()
+
+	s := New()
+	if s.GetRequestID() != "" {
+		t.Errorf("request id before RequestID = %q", s.GetRequestID())
+	}
+	body, _, err := s.Post(ts.URL).IdempotencyKey("order-42").RequestID().Send(`{"a":1}`).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := s.GetRequestID()
+	if len(id) != 36 || id[14] != '4' {
+		t.Errorf("request id %q is not a uuid v4", id)
+	}
+	if body != "order-42|"+id {
+		t.Errorf("body = %q, want the key and %q", body, id)
+	}
+
+	if body, _, _ = s.Post(ts.URL).RequestID().String(); body == "|"+id || !strings.HasPrefix(body, "|") {
+		t.Errorf("next request: body = %q, want no key and a new id", body)
+	}
+}
+
+func TestExists(t *testing.T) {
+	var last atomic.Value
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		last.Store(fmt.Sprintf("%s %q %d", r.Method, r.Header.Get("Content-Type"), len(body)))
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", "5")
+	}))
+	defer ts.Close()
+
+	// the body of a POST agent isn't sent with the HEAD
+	ok, size, err := New().Post(ts.URL).Send(`{"a":1}`).Exists()
+	if err != nil || !ok || size != 5 {
+		t.Errorf("Exists() = %v, %d, %v", ok, size, err)
+	}
+	if got := last.Load(); got != `HEAD "" 0` {
+		t.Errorf("request = %s", got)
+	}
+
+	if ok, _, err = New().Head(ts.URL + "/missing").Exists(); err != nil || ok {
+		t.Errorf("missing: ok = %v, err = %v", ok, err)
+	}
+}
+
+func TestTotalTimeout(t *testing.T) {
+	cancelled := make(chan bool, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- true
+		case <-time.After(2 * time.Second):
+			cancelled <- false
+		}
+	}))
+	defer ts.Close()
+
+	start := time.Now()
+	_, errs := New().Timeout(time.Minute).TotalTimeout(100 * time.Millisecond).Get(ts.URL).End()
+	if errs == nil {
+		t.Fatal("attempt outlived the total timeout")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %v with a 100ms total timeout", elapsed)
+	}
+	if !<-cancelled {
+		t.Error("attempt in flight not cancelled")
+	}
+}
+
+func TestHostDelayPerIP(t *testing.T) {
+	host := "delay.gohttp.test"
+	SetHostDelay(host, 200*time.Millisecond)
+	defer SetHostDelay(host, 0)
+
+	roll := NewIpRollClient("127.0.0.1", "127.0.0.2")
+	start := time.Now()
+	elapsed := make([]time.Duration, 4)
+	for i := range elapsed {
+		if _, err := roll.GetHttpClient("http://"+host+"/", "", true); err != nil {
+			t.Fatal(err)
+		}
+		elapsed[i] = time.Now().Sub(start)
+	}
+
+	// the second ip is used right away, each ip waits for its own previous request
+	if elapsed[1] > 100*time.Millisecond {
+		t.Errorf("second ip delayed: %s", elapsed[1])
+	}
+	if elapsed[2] < 200*time.Millisecond || elapsed[3] < 200*time.Millisecond {
+		t.Errorf("reused ip not delayed: %s, %s", elapsed[2], elapsed[3])
+	}
+	if elapsed[3] > 350*time.Millisecond {
+		t.Errorf("delay computed against the other ip: %s", elapsed[3])
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprintf(w, "%s %s", r.Header.Get("Authorization"), r.Header.Get("Accept-Language"))
+	}))
+	defer ts.Close()
+	EnableCache(10)
+	defer EnableCache(0)
+	get := func(s *HttpAgent) string {
+		body, _, err := s.Jar(false).Get(ts.URL).Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	body := []byte(get(New().Set("Accept-Language", "en")))
+	s := New().Set("Accept-Language", "en")
+	cached, _, _ := s.Jar(false).Get(ts.URL).Bytes()
+	if !s.Cached() || string(cached) != string(body) || atomic.LoadInt32(&hits) != 1 {
+		t.Fatalf("second request not served from the cache, hits = %d", hits)
+	}
+	// the cached body belongs to the caller
+	cached[0] = 'X'
+	if got := get(New().Set("Accept-Language", "en")); got != string(body) {
+		t.Errorf("cache corrupted by the caller: %q", got)
+	}
+
+	if got := get(New().Set("Accept-Language", "fr")); got != " fr" || atomic.LoadInt32(&hits) != 2 {
+		t.Errorf("Vary ignored: body = %q, hits = %d", got, hits)
+	}
+	if got := get(New().Set("Accept-Language", "en").Set("Authorization", "Bearer a")); got != "Bearer a en" {
+		t.Errorf("authorized request served from the cache: %q", got)
+	}
+	if got := get(New().Set("Accept-Language", "de").Set("Authorization", "Bearer a")); got != "Bearer a de" {
+		t.Errorf("body = %q", got)
+	}
+	if got := get(New().Set("Accept-Language", "de")); got != " de" {
+		t.Errorf("authorized response cached: %q", got)
+	}
+}
+
+func TestFinalURL(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/a", http.RedirectHandler("/b", http.StatusFound))
+	mux.Handle("/b", http.RedirectHandler("/c?x=1", http.StatusMovedPermanently))
+	mux.HandleFunc("/c", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ok":true}`)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	s := New()
+	if s.FinalURL() != "" {
+		t.Errorf("FinalURL before sending = %q", s.FinalURL())
+	}
+	if body, _, err := s.Get(ts.URL + "/a").String(); err != nil || body != `{"ok":true}` {
+		t.Fatalf("body = %q, err = %v", body, err)
+	}
+	if s.FinalURL() != ts.URL+"/c?x=1" {
+		t.Errorf("String: FinalURL = %q", s.FinalURL())
+	}
+
+	var v struct{ OK bool }
+	if _, err := s.Get(ts.URL + "/b").ToJSON(&v); err != nil || !v.OK {
+		t.Fatalf("v = %+v, err = %v", v, err)
+	}
+	if s.FinalURL() != ts.URL+"/c?x=1" {
+		t.Errorf("ToJSON: FinalURL = %q", s.FinalURL())
+	}
+
+	if s.Get(ts.URL + "/c"); s.FinalURL() != "" {
+		t.Errorf("FinalURL kept for the next request = %q", s.FinalURL())
+	}
+}
+
+func TestSetBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %d %q", r.Method, r.Header.Get("Content-Type"), r.ContentLength, body)
+	}))
+	defer ts.Close()
+
+	// not valid json nor a form, sent untouched whatever Type and Send say
+	blob := []byte("\x00\x01a=1&{\"b\"")
+	for _, method := range []string{POST, PUT, PATCH} {
+		s := New()
+		switch method {
+		case POST:
+			s.Post(ts.URL)
+		case PUT:
+			s.Put(ts.URL)
+		case PATCH:
+			s.Patch(ts.URL)
+		}
+		body, _, err := s.Type("json").Send(`{"c":3}`).SetBody(bytes.NewReader(blob), "application/x-protobuf").String()
+		want := fmt.Sprintf("%s application/x-protobuf %d %q", method, len(blob), blob)
+		if err != nil || body != want {
+			t.Errorf("%s: body = %s, err = %v, want %s", method, body, err, want)
+		}
+	}
+}
+
+func TestIPv6Address(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 not available:", err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		w.Write([]byte(host))
+	}))
+	ts.Listener = ln
+	ts.Start()
+	defer ts.Close()
+
+	req := New()
+	req.Getter = NewIpRollClient("::1")
+	body, _, err := req.Get(ts.URL).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "::1" {
+		t.Errorf("remote addr = %q", body)
+	}
+
+	req.Getter = NewIpRollClient("not-an-ip.invalid")
+	if _, errs := req.Get(ts.URL).End(); errs == nil {
+		t.Error("expected error for an unresolvable address")
+	}
+}
+
+func TestSetOptionKeepsTransport(t *testing.T) {
+	before := GetDefaultTransport()
+	option := GetOption()
+	SetOption(&Option{Agent: option.Agent, MaxIdleConns: option.MaxIdleConns, MaxConnsPerHost: option.MaxConnsPerHost})
+	if GetDefaultTransport() != before {
+		t.Error("transport rebuilt though no transport option changed")
+	}
+
+	SetOption(&Option{MaxConnsPerHost: option.MaxConnsPerHost + 100})
+	if GetDefaultTransport() == before {
+		t.Error("transport not rebuilt for a changed MaxConnsPerHost")
+	}
+
+	// SetOption can't unset MaxConnsPerHost
+	optionLock.Lock()
+	defaultOption.MaxConnsPerHost = option.MaxConnsPerHost
+	defaultTransport = before
+	optionLock.Unlock()
+	GetDefaultGetter().(*IpRollClient).rebuildTransports()
+}
+
+func TestBytesInfo(t *testing.T) {
+	plain := strings.Repeat("compress me ", 100)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(plain))
+	zw.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/old", http.RedirectHandler("/data", http.StatusFound))
+	mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write([]byte(plain))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gz.Bytes())
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	body, info, err := New().Get(ts.URL + "/old").BytesInfo(http.StatusOK)
+	if err != nil || string(body) != plain {
+		t.Fatalf("body = %q, err = %v", body, err)
+	}
+	want := ResponseInfo{
+		StatusCode:       http.StatusOK,
+		ContentEncoding:  "gzip",
+		CompressedSize:   int64(gz.Len()),
+		DecompressedSize: int64(len(plain)),
+		FinalURL:         ts.URL + "/data",
+	}
+	if info != want {
+		t.Errorf("info = %+v, want %+v", info, want)
+	}
+
+	// identity when the caller asks for it
+	_, info, _ = New().Get(ts.URL+"/data").Set("Accept-Encoding", "identity").BytesInfo()
+	if info.ContentEncoding != "" || info.CompressedSize != int64(len(plain)) || info.DecompressedSize != int64(len(plain)) {
+		t.Errorf("identity: info = %+v", info)
+	}
+}
+
+func TestSetOptionConcurrent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			SetOption(&Option{
+				Agent:      "gohttp v1.0",
+				TLSTimeout: 30 * time.Second,
+			})
+		}()
+		go func() {
+			defer wg.Done()
+			if _, _, err := New().Get(ts.URL).Bytes(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTotalTimeoutRetries(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	policy := DefaultRetryPolicy()
+	policy.MaxAttempts = 10
+	policy.BaseDelay = 100 * time.Millisecond
+	policy.Multiplier = 1
+	policy.Jitter = 0
+
+	// the budget runs out while waiting to retry: the last response is returned, no more attempts are sent
+	start := time.Now()
+	resp, errs := New().SetRetryPolicy(policy).TotalTimeout(250 * time.Millisecond).Get(ts.URL).End()
+	if errs != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("resp = %v, errs = %v, want the last 503", resp, errs)
+	} else {
+		resp.Body.Close()
+	}
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Errorf("retries took %v with a 250ms total timeout", elapsed)
+	}
+	if n := atomic.LoadInt32(&calls); n < 2 || n > 3 {
+		t.Errorf("%d attempts in 250ms, 100ms apart", n)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var calls int32
+	var keys []string
+	var keysLock sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keysLock.Lock()
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		keysLock.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	policy := DefaultRetryPolicy()
+	policy.BaseDelay = time.Millisecond
+	_, code, _ := New().SetRetryPolicy(policy).Post(ts.URL).Send(`{"a":1}`).String()
+	if code != http.StatusServiceUnavailable || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("POST retried: status = %d after %d calls", code, calls)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	keys = nil
+	body, _, err := New().SetRetryPolicy(policy).Post(ts.URL).IdempotencyKey("k1").Send(`{"a":1}`).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != `{"a":1}` || atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("body = %q after %d calls", body, calls)
+	}
+	if strings.Join(keys, ",") != "k1,k1,k1" {
+		t.Errorf("idempotency keys of the attempts = %q", keys)
+	}
+
+	// PUT is idempotent, retried without a key
+	atomic.StoreInt32(&calls, 0)
+	if body, _, err = New().SetRetryPolicy(policy).Put(ts.URL).Send(`{"b":2}`).String(); err != nil || body != `{"b":2}` {
+		t.Errorf("PUT: body = %q, err = %v after %d calls", body, err, calls)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	policy.MaxAttempts = 2
+	resp, _ := New().SetRetryPolicy(policy).Get(ts.URL).End()
+	if resp.StatusCode != http.StatusServiceUnavailable || atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("status = %d after %d calls", resp.StatusCode, calls)
+	}
+}
+
+func TestCharset(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Content-Type")))
+	}))
+	defer ts.Close()
+
+	cases := []struct {
+		agent *HttpAgent
+		want  string
+	}{
+		{New().Post(ts.URL).Type("form").Send("a=1"), "application/x-www-form-urlencoded; charset=UTF-8"},
+		{New().Post(ts.URL).Type("text").Send("a"), "text/plain; charset=UTF-8"},
+		{New().Post(ts.URL).Charset("GBK").Send(`{"a":1}`), "application/json; charset=GBK"},
+		{New().Post(ts.URL).Charset("").Type("xml").Send("<a/>"), "text/xml"},
+		{New().Post(ts.URL).Set("Content-Type", "application/vnd.api+json").Send(`{"a":1}`), "application/vnd.api+json"},
+	}
+	for _, c := range cases {
+		body, _, err := c.agent.String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != c.want {
+			t.Errorf("Content-Type = %q, want %q", body, c.want)
+		}
+	}
+}
+
+func TestSetContentType(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Content-Type")))
+	}))
+	defer ts.Close()
+
+	const custom = "application/vnd.x+json"
+	for _, typ := range []string{"json", "form", "text", "xml", "stream", "application/x-custom"} {
+		body, _, err := New().Post(ts.URL).Type(typ).SendBytes([]byte("a=1")).Set("Content-Type", custom).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != custom {
+			t.Errorf("Type(%q): Content-Type = %q, want %q", typ, body, custom)
+		}
+	}
+	body, _, _ := New().Put(ts.URL).SetBody(strings.NewReader("x"), "text/plain").Set("content-type", custom).String()
+	if body != custom {
+		t.Errorf("SetBody: Content-Type = %q, want %q", body, custom)
+	}
+
+	for _, c := range []struct{ typ, set, want string }{
+		{"multipart", custom, "multipart/form-data"},
+		{"multipart", "multipart/mixed", "multipart/mixed"},
+		{"related", custom, "multipart/related"},
+		{"related", `multipart/related; type="application/json"`, "multipart/related"},
+	} {
+		body, _, err := New().Post(ts.URL).Type(c.typ).Send("a=1").Set("Content-Type", c.set).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mt, params, err := mime.ParseMediaType(body)
+		if err != nil || mt != c.want || params["boundary"] == "" {
+			t.Errorf("Type(%q) Set(%q): Content-Type = %q", c.typ, c.set, body)
+		}
+	}
+}
+
+func TestToValue(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"items":[{"name":"a","id":12345678901234567}]}}`))
+	}))
+	defer ts.Close()
+
+	v, _, err := New().Get(ts.URL).ToValue("data.items.0.name")
+	if err != nil || v != "a" {
+		t.Errorf("name = %v, %v", v, err)
+	}
+	v, _, err = New().Get(ts.URL).ToValue("data.items.0.id")
+	if n, ok := v.(json.Number); err != nil || !ok || n.String() != "12345678901234567" {
+		t.Errorf("id = %#v, %v", v, err)
+	}
+	for _, path := range []string{"data.missing", "data.items.1", "data.items.x", "data.items.0.name.x"} {
+		if _, _, err := New().Get(ts.URL).ToValue(path); err == nil {
+			t.Errorf("ToValue(%q): expected error", path)
+		}
+	}
+}
+
+func TestSendReaderChunked(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%v %d %s", r.TransferEncoding, r.ContentLength, body)
+	}))
+	defer ts.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("hello "))
+		pw.Write([]byte("world"))
+		pw.Close()
+	}()
+	body, _, err := New().Post(ts.URL).SendReader(pr, -1).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "[chunked] -1 hello world" {
+		t.Errorf("chunked body = %q", body)
+	}
+
+	body, _, _ = New().Post(ts.URL).SendReader(ioutil.NopCloser(strings.NewReader("abc")), 3).String()
+	if body != "[] 3 abc" {
+		t.Errorf("known length body = %q", body)
+	}
+}
+
+func TestQueryRepeated(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RawQuery))
+	}))
+	defer ts.Close()
+
+	body, _, err := New().Get(ts.URL).Query("id=1&id=2").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "id=1&id=2" {
+		t.Errorf("RawQuery = %q, want id=1&id=2", body)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestResetJarWithClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", Path: "/"})
+	}))
+	defer ts.Close()
+
+	jar := MakeCookiejar()
+	c := &http.Client{Jar: jar}
+	s := New().WithClient(c).ResetJar()
+	if _, errs := s.Get(ts.URL).End(); errs != nil {
+		t.Fatal(errs)
+	}
+	uri, _ := url.Parse(ts.URL)
+	if c.Jar != jar || len(jar.Cookies(uri)) != 0 {
+		t.Error("ResetJar changed the client given to WithClient")
+	}
+	if len(s.CookieJar.Cookies(uri)) != 1 {
+		t.Error("cookie not stored in the agent's new jar")
+	}
+}
+
+func TestWithClient(t *testing.T) {
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader("mocked " + req.URL.Path)),
+			Request:    req,
+		}, nil
+	})}
+
+	body, _, err := New().WithClient(client).MaxRedirect(0).Timeout(time.Second).Get("http://gohttp.invalid/a").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "mocked /a" {
+		t.Errorf("body = %q", body)
+	}
+	if client.CheckRedirect != nil || client.Timeout != 0 {
+		t.Error("WithClient client was modified")
+	}
+}
+
+func TestSendReaderFile(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, h, err := r.FormFile("archive")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(f)
+		fmt.Fprintf(w, "%s %s", h.Filename, data)
+	}))
+	defer ts.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("zip"))
+		pw.Write([]byte("data"))
+		pw.Close()
+	}()
+	body, _, err := New().Post(ts.URL).Type("multipart").SendReaderFile(pr, 7, "backup.zip", "archive").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "backup.zip zipdata" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestHostSNI(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Host, r.TLS.ServerName)
+	}))
+	defer ts.Close()
+
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	roots := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	body, _, err := New().
+		TLSClientConfig(&tls.Config{RootCAs: roots}).
+		Resolve("backend.gohttp.test", "127.0.0.1").
+		Host("example.com").
+		Get("https://backend.gohttp.test:" + port + "/").
+		String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "example.com example.com" {
+		t.Errorf("Host and SNI = %q", body)
+	}
+}
+
+func TestStackedContentEncoding(t *testing.T) {
+	const payload = "stacked payload"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var gz, br bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		zw.Write([]byte(payload))
+		zw.Close()
+		bw := brotli.NewWriter(&br)
+		bw.Write(gz.Bytes())
+		bw.Close()
+
+		if r.URL.Path == "/unknown" {
+			w.Header().Set("Content-Encoding", "gzip, zstd")
+		} else {
+			w.Header().Set("Content-Encoding", "gzip, br")
+		}
+		w.Write(br.Bytes())
+	}))
+	defer ts.Close()
+
+	body, _, err := New().Get(ts.URL).Set("Accept-Encoding", "gzip, br").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != payload {
+		t.Errorf("body = %q", body)
+	}
+	if _, _, err := New().Get(ts.URL+"/unknown").Set("Accept-Encoding", "gzip").String(); err == nil {
+		t.Error("expected an error for an unknown encoding")
+	}
+}
+
+func TestConfigureTransport(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	shared := GetDefaultTransport().ResponseHeaderTimeout
+	_, errs := New().ConfigureTransport(func(t *http.Transport) {
+		t.ResponseHeaderTimeout = 10 * time.Millisecond
+	}).Get(ts.URL).End()
+	if errs == nil {
+		t.Error("expected a response header timeout")
+	}
+	if GetDefaultTransport().ResponseHeaderTimeout != shared {
+		t.Error("shared transport was modified")
+	}
+}
+
+func TestClearHostDelay(t *testing.T) {
+	host := "clear.gohttp.test"
+	SetHostDelay(host, time.Second)
+	SetHostDelay(host, time.Millisecond)
+	if d := GetHostDelay(host); d != time.Millisecond {
+		t.Errorf("lowered delay = %v", d)
+	}
+	ClearHostDelay(host)
+	if d := GetHostDelay(host); d != GetOption().Delay {
+		t.Errorf("cleared delay = %v", d)
+	}
+	SetHostDelay(host, time.Second)
+	ClearAllDelays()
+	if d := GetHostDelay(host); d != GetOption().Delay {
+		t.Errorf("delay after ClearAllDelays = %v", d)
+	}
+}
+
+func TestEndBytes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("body"))
+	}))
+	defer ts.Close()
+
+	var got []byte
+	resp, body, errs := New().Get(ts.URL).EndBytes(func(resp *http.Response, body []byte, errs []error) {
+		got = body
+	})
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	again, _ := ioutil.ReadAll(resp.Body)
+	if string(got) != "body" || string(body) != "body" || string(again) != "body" {
+		t.Errorf("callback %q, returned %q, resp.Body %q", got, body, again)
+	}
+}
+
+func TestSetParam(t *testing.T) {
+	s := New().Get("/items").Param("page", "1").Param("sort", "name")
+	s.SetParam("page", "2")
+	if got := s.QueryData.Encode(); got != "page=2&sort=name" {
+		t.Errorf("after SetParam query = %q", got)
+	}
+	s.ClearQuery().Param("page", "3")
+	if got := s.QueryData.Encode(); got != "page=3" {
+		t.Errorf("after ClearQuery query = %q", got)
+	}
+}
+
+func TestParams(t *testing.T) {
+	s := New().Get("/items").Params("fields", "a", "b", "c")
+	if got := s.QueryData.Encode(); got != "fields=a&fields=b&fields=c" {
+		t.Errorf("query = %q", got)
+	}
+	s.Params("fields", "d").Params("empty")
+	if got := s.QueryData.Encode(); got != "fields=a&fields=b&fields=c&fields=d" {
+		t.Errorf("after a second Params query = %q", got)
+	}
+}
+
+func TestCompressBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := decodeReader(r.Header.Get("Content-Encoding"), r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(reader)
+		fmt.Fprintf(w, "%s %s", r.Header.Get("Content-Encoding"), body)
+	}))
+	defer ts.Close()
+
+	for _, enc := range []string{"gzip", "br"} {
+		body, _, err := New().Post(ts.URL).CompressBody(enc).Send(`{"a":1}`).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := enc + ` {"a":1}`; body != want {
+			t.Errorf("CompressBody(%q): got %q, want %q", enc, body, want)
+		}
+	}
+	if errs := New().Post(ts.URL).CompressBody("zstd").Errors; errs == nil {
+		t.Error("expected an error for an unsupported encoding")
+	}
+}
+
+func TestSendFilePipe(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(f)
+		fmt.Fprintf(w, "%v %s", r.TransferEncoding, data)
+	}))
+	defer ts.Close()
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		pw.Write([]byte("from a pipe"))
+		pw.Close()
+	}()
+	body, _, err := New().Post(ts.URL).Type("multipart").SendFile(pr, "pipe.txt").String()
+	pr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "[chunked] from a pipe" {
+		t.Errorf("body = %q", body)
+	}
+
+	f, err := ioutil.TempFile("", "gohttp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(f.Name())
+	f.Close()
+	if errs := New().Post(ts.URL).Type("multipart").SendFile(f).Errors; errs == nil {
+		t.Error("expected an error for a closed file")
+	}
+}
+
+func TestSampleLogger(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer ts.Close()
+
+	var logs []RequestLog
+	SetSampleLogger(1, func(info RequestLog) {
+		logs = append(logs, info)
+	})
+	New().Get(ts.URL + "/sampled").End()
+	SetSampleLogger(0, nil)
+	New().Get(ts.URL + "/skipped").End()
+
+	if len(logs) != 1 {
+		t.Fatalf("%d requests logged, want 1", len(logs))
+	}
+	info := logs[0]
+	if info.Method != GET || info.URL != ts.URL+"/sampled" || info.StatusCode != http.StatusTeapot || info.SourceIP != "127.0.0.1" {
+		t.Errorf("logged %+v", info)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	if _, errs := New().Network("tcp4").Get(ts.URL).End(); errs != nil {
+		t.Errorf("tcp4: %v", errs)
+	}
+	if _, errs := New().Network("tcp6").Get(ts.URL).End(); errs == nil {
+		t.Error("tcp6 reached an IPv4 address")
+	}
+	if errs := New().Network("udp").Errors; errs == nil {
+		t.Error("expected an error for udp")
+	}
+}
+
+func TestToStruct(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") == "application/xml" {
+			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			w.Write([]byte(`<item><name>xml</name></item>`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"name":"json"}`))
+	}))
+	defer ts.Close()
+
+	type item struct {
+		Name string `json:"name" xml:"name"`
+	}
+	for _, accept := range []string{"application/xml", "application/json"} {
+		var v item
+		if _, err := New().Get(ts.URL).Set("Accept", accept).ToStruct(&v); err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.TrimPrefix(accept, "application/"); v.Name != want {
+			t.Errorf("Accept %s: name = %q, want %q", accept, v.Name, want)
+		}
+	}
+}
+
+func TestAddField(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseMultipartForm(1 << 20)
+		fmt.Fprint(w, r.PostForm["tags"], r.PostForm.Get("name"))
+	}))
+	defer ts.Close()
+
+	for _, typ := range []string{"form", "multipart"} {
+		body, _, err := New().Post(ts.URL).Type(typ).Send("name=x").AddField("tags", "a").AddField("tags", "b").String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != "[a b]x" {
+			t.Errorf("%s body = %q", typ, body)
+		}
+	}
+}
+
+func TestTLSSessionCacheOption(t *testing.T) {
+	before := GetDefaultGetter()
+	SetOption(&Option{TLSSessionCache: 8})
+	if GetDefaultGetter() != before {
+		t.Error("TLSSessionCache replaced the client getter")
+	}
+	if config := GetDefaultTransport().TLSClientConfig; config == nil || config.ClientSessionCache == nil {
+		t.Error("session cache not attached")
+	}
+
+	SetOption(&Option{TLSSessionCache: -1})
+	if config := GetDefaultTransport().TLSClientConfig; config != nil && config.ClientSessionCache != nil {
+		t.Error("session cache kept after TLSSessionCache -1")
+	}
+	if GetOption().TLSSessionCache != 0 {
+		t.Errorf("TLSSessionCache = %d", GetOption().TLSSessionCache)
+	}
+}
+
+func BenchmarkTLSSessionCache(b *testing.B) {
+	var resumed int64
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS.DidResume {
+			atomic.AddInt64(&resumed, 1)
+		}
+	}))
+	defer ts.Close()
+	roots := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	// every request opens a new connection, keep-alives are off by default
+	run := func(b *testing.B) {
+		atomic.StoreInt64(&resumed, 0)
+		for i := 0; i < b.N; i++ {
+			if _, _, err := New().TLSClientConfig(&tls.Config{RootCAs: roots}).Get(ts.URL).String(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&resumed))/float64(b.N), "resumed/op")
+	}
+	b.Run("NoCache", run)
+	SetOption(&Option{TLSSessionCache: 64})
+	defer SetOption(&Option{TLSSessionCache: -1})
+	b.Run("Cache", run)
+}
+
+func TestCancel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	s := New()
+	s.Cancel() // nothing in flight
+	s.Get(ts.URL)
+	time.AfterFunc(50*time.Millisecond, s.Cancel)
+	start := time.Now()
+	if _, _, err := s.Bytes(); err == nil {
+		t.Error("expected the cancelled read to fail")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Cancel took %v", d)
+	}
+}
+
+func TestRetryConnReset(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// drop the connection without answering
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	cases := []struct {
+		agent *HttpAgent
+		ok    bool
+		calls int32
+	}{
+		{New().Get(ts.URL), true, 2},
+		{New().Head(ts.URL), true, 2},
+		{New().Post(ts.URL).Send(`{"a":1}`), false, 1},
+		{New().Post(ts.URL).Send(`{"a":1}`).IdempotencyKey("k1"), true, 2},
+	}
+	for i, c := range cases {
+		atomic.StoreInt32(&calls, 0)
+		_, errs := c.agent.End()
+		if (errs == nil) != c.ok || atomic.LoadInt32(&calls) != c.calls {
+			t.Errorf("case %d: errs = %v after %d calls", i, errs, calls)
+		}
+	}
+}
+
+func TestFileHeader(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, h, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%s %s", h.Header.Get("Content-Encoding"), h.Header.Get("Content-Type"))
+	}))
+	defer ts.Close()
+
+	body, _, err := New().Post(ts.URL).Type("multipart").
+		SendFile([]byte("gz"), "data.json.gz", "file", "application/json").
+		FileHeader("Content-Encoding", "gzip").
+		String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "gzip application/json" {
+		t.Errorf("part headers = %q", body)
+	}
+}
+
+func TestMaxIdleConns(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	shared := GetDefaultTransport()
+	keepAlives, idle := shared.DisableKeepAlives, shared.MaxIdleConnsPerHost
+	for _, n := range []int{3, 0} {
+		reused := false
+		ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+		})
+		req := NewSingle().MaxIdleConns(n).WithContext(ctx)
+		for i := 0; i < 2; i++ {
+			if _, _, err := req.Get(ts.URL).Bytes(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if reused != (n > 0) {
+			t.Errorf("MaxIdleConns(%d): reused = %v", n, reused)
+		}
+	}
+	if shared.DisableKeepAlives != keepAlives || shared.MaxIdleConnsPerHost != idle {
+		t.Error("shared transport was modified")
+	}
+}
+
+func TestEndCallbackBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("logged"))
+	}))
+	defer ts.Close()
+
+	var logged []byte
+	resp, errs := New().Get(ts.URL).End(func(resp *http.Response, errs []error) {
+		logged, _ = ioutil.ReadAll(resp.Body)
+	})
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(logged) != "logged" || string(body) != "logged" {
+		t.Errorf("callback read %q, caller read %q", logged, body)
+	}
+}
+
+func TestQueryCSV(t *testing.T) {
+	s := New().Get("/_search").QueryCSV(struct {
+		Fields []string `json:"fields"`
+		Size   int      `json:"size"`
+	}{[]string{"a", "b"}, 10})
+	if got := s.QueryData.Encode(); got != "fields=a%2Cb&size=10" {
+		t.Errorf("query = %q", got)
+	}
+}
+
+func TestNoCookies(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1"})
+		}
+		w.Write([]byte(r.Header.Get("Cookie")))
+	}))
+	defer ts.Close()
+
+	s := NewSingle().PrivateJar()
+	s.Get(ts.URL + "/login").End()
+	body, _, _ := s.Get(ts.URL).AddCookie(&http.Cookie{Name: "extra", Value: "1"}).NoCookies().String()
+	if body != "" {
+		t.Errorf("NoCookies sent %q", body)
+	}
+	body, _, _ = s.Get(ts.URL).String()
+	if !strings.Contains(body, "session=s1") || !strings.Contains(body, "extra=1") {
+		t.Errorf("next request sent %q", body)
+	}
+}
+
+func TestMultipartMethods(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, h, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(f)
+		fmt.Fprintf(w, "%s %s %s %s", r.Method, r.FormValue("name"), h.Filename, data)
+	}))
+	defer ts.Close()
+
+	for _, method := range []string{POST, PUT, PATCH} {
+		s := New()
+		switch method {
+		case POST:
+			s.Post(ts.URL)
+		case PUT:
+			s.Put(ts.URL)
+		case PATCH:
+			s.Patch(ts.URL)
+		}
+		body, _, err := s.Type("multipart").Send("name=doc").SendFile([]byte("content"), "doc.txt").String(http.StatusOK)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		if want := method + " doc doc.txt content"; body != want {
+			t.Errorf("%s: got %q, want %q", method, body, want)
+		}
+	}
+}
+
+func TestStreamTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "second\n")
+	}))
+	defer ts.Close()
+
+	defer SetOption(&Option{Timeout: GetOption().Timeout})
+	SetOption(&Option{Timeout: 50 * time.Millisecond})
+
+	var buf bytes.Buffer
+	if _, _, err := New().Get(ts.URL).WriteTo(&buf); err != nil || buf.String() != "first\nsecond\n" {
+		t.Errorf("WriteTo = %q, %v", buf.String(), err)
+	}
+	if _, _, err := New().Timeout(100 * time.Millisecond).Get(ts.URL).WriteTo(ioutil.Discard); err == nil {
+		t.Error("Timeout not applied to WriteTo")
+	}
+}
+
+func TestDefaultTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	defer SetOption(&Option{Timeout: GetOption().Timeout})
+	SetOption(&Option{Timeout: 50 * time.Millisecond})
+
+	if _, errs := New().Get(ts.URL).End(); errs == nil {
+		t.Error("Option.Timeout was not applied")
+	}
+	if _, errs := New().Timeout(time.Second).Get(ts.URL).End(); errs != nil {
+		t.Errorf("Timeout(1s): %v", errs)
+	}
+	if _, errs := New().Timeout(0).Get(ts.URL).End(); errs != nil {
+		t.Errorf("Timeout(0): %v", errs)
+	}
+}
+
+func TestAddFieldWithType(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			data, _ := ioutil.ReadAll(part)
+			fmt.Fprintf(w, "%s:%s:%s;", part.FormName(), part.Header.Get("Content-Type"), data)
+		}
+	}))
+	defer ts.Close()
+
+	body, _, err := New().Post(ts.URL).
+		AddFieldWithType("metadata", `{"a":1}`, "application/json").
+		SendFile([]byte("pdf"), "r.pdf", "file", "application/pdf").
+		String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `metadata:application/json:{"a":1};file:application/pdf:pdf;`; body != want {
+		t.Errorf("got %q, want %q", body, want)
+	}
+}
+
+func TestJitterDelay(t *testing.T) {
+	if d := jitterDelay(time.Second, 0); d != time.Second {
+		t.Errorf("no jitter: %v", d)
+	}
+	for i := 0; i < 100; i++ {
+		if d := jitterDelay(time.Second, 0.3); d < 700*time.Millisecond || d > 1300*time.Millisecond {
+			t.Fatalf("jitter 0.3: %v", d)
+		}
+		if d := jitterDelay(time.Second, 2); d < 0 {
+			t.Fatalf("jitter 2: %v", d)
+		}
+	}
+}
+
+func TestResetClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	s := NewSingle()
+	s.Get(ts.URL).End()
+	first := s.Client
+	if first == nil {
+		t.Fatal("NewSingle did not cache its client")
+	}
+	s.ResetClient().Get(ts.URL).End()
+	if s.Client == nil || s.Client == first {
+		t.Error("ResetClient did not get a fresh client")
+	}
+}
+
+type readFlag struct {
+	io.Reader
+	read int32
+}
+
+func (r *readFlag) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&r.read, 1)
+	return r.Reader.Read(p)
+}
+
+func TestExpect100Continue(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	body := &readFlag{Reader: strings.NewReader("large upload")}
+	resp, errs := New().Expect100Continue().Put(ts.URL).SendReader(body, 12).End()
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	if resp.StatusCode != http.StatusUnauthorized || atomic.LoadInt32(&body.read) != 0 {
+		t.Errorf("status %d, body read = %v", resp.StatusCode, body.read != 0)
+	}
+
+	got, _, err := New().Expect100Continue().Put(ts.URL).Set("Authorization", "Bearer t").SendReader(strings.NewReader("large upload"), 12).String()
+	if err != nil || got != "large upload" {
+		t.Errorf("authorized upload: %q, %v", got, err)
+	}
+}
+
+func TestDo(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "c", Value: "1"})
+		w.Header().Set("X-Test", "yes")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"name":"do"}`))
+	}))
+	defer ts.Close()
+
+	resp, err := New().Post(ts.URL).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct{ Name string }
+	if err := resp.JSON(&v); err != nil || v.Name != "do" {
+		t.Errorf("JSON: %+v, %v", v, err)
+	}
+	if resp.String() != `{"name":"do"}` || string(resp.Bytes()) != resp.String() {
+		t.Errorf("body = %q", resp.String())
+	}
+	if resp.StatusCode() != http.StatusCreated || resp.Header("X-Test") != "yes" {
+		t.Errorf("status %d, header %q", resp.StatusCode(), resp.Header("X-Test"))
+	}
+	if c := resp.Cookies(); len(c) != 1 || c[0].Value != "1" {
+		t.Errorf("cookies = %v", c)
+	}
+}
+
+func TestJarFalse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/set" {
+			http.SetCookie(w, &http.Cookie{Name: "leak", Value: "1"})
+		}
+		w.Write([]byte(r.Header.Get("Cookie")))
+	}))
+	defer ts.Close()
+
+	for _, s := range []*HttpAgent{New(), New().PrivateJar()} {
+		s.Jar(false).Get(ts.URL + "/set").End()
+		body, _, _ := s.Jar(true).Get(ts.URL + "/get").String()
+		if strings.Contains(body, "leak=") {
+			t.Errorf("cookie of a Jar(false) request leaked: %q", body)
+		}
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	_, errs := New().Get(ts.URL).Deadline(time.Now().Add(50 * time.Millisecond)).Timeout(time.Second).End()
+	if errs == nil || errs[0] != context.DeadlineExceeded {
+		t.Errorf("Deadline: %v", errs)
+	}
+	_, errs = New().Get(ts.URL).Deadline(time.Now().Add(time.Second)).Timeout(50 * time.Millisecond).End()
+	if errs == nil || errs[0] == context.DeadlineExceeded {
+		t.Errorf("Timeout: %v", errs)
+	}
+	if _, errs = New().Get(ts.URL).Deadline(time.Now().Add(time.Second)).End(); errs != nil {
+		t.Errorf("deadline not reached: %v", errs)
+	}
+}
+
+func TestSendFiles(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		names := make([]string, 0)
+		for field, files := range r.MultipartForm.File {
+			for _, h := range files {
+				f, _ := h.Open()
+				data, _ := ioutil.ReadAll(f)
+				names = append(names, fmt.Sprintf("%s=%s:%s:%s", field, h.Filename, h.Header.Get("Content-Type"), data))
+			}
+		}
+		sort.Strings(names)
+		fmt.Fprint(w, strings.Join(names, ";"), " name=", r.FormValue("name"))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "gohttp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.json")
+	ioutil.WriteFile(a, []byte("A"), 0644)
+	ioutil.WriteFile(b, []byte("{}"), 0644)
+
+	body, _, err := New().Post(ts.URL).Type("multipart").Send("name=x").SendFiles([]string{a, b}, "files[]").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "files[]=a.txt:text/plain; charset=utf-8:A;files[]=b.json:application/json:{} name=x"; body != want {
+		t.Errorf("got %q, want %q", body, want)
+	}
+
+	s := New().Post(ts.URL).Type("multipart").SendFiles([]string{a, filepath.Join(dir, "missing"), b}, "file")
+	if len(s.Errors) != 1 || len(s.FileData) != 2 || s.FileData[1].Fieldname != "file3" {
+		t.Errorf("errors %v, %d files", s.Errors, len(s.FileData))
+	}
+}
+
+func TestBodyString(t *testing.T) {
+	cases := []struct {
+		agent *HttpAgent
+		want  string
+	}{
+		{New().Post("http://example.com").Send(`{"a":1}`), `{"a":1}`},
+		{New().Post("http://example.com").Type("form").Send(`{"a":1,"b":"x y"}`), "a=1&b=x+y"},
+		{New().Put("http://example.com").Type("text").Send("plain"), "plain"},
+		{New().Post("http://example.com").Type("multipart").Send("a=1").SendFile([]byte("f")), "<multipart body with 1 fields and 1 files>"},
+		{New().Get("http://example.com"), ""},
+	}
+	for _, c := range cases {
+		target := c.agent.TargetType
+		got, err := c.agent.BodyString()
+		if err != nil || got != c.want {
+			t.Errorf("BodyString() = %q, %v, want %q", got, err, c.want)
+		}
+		if c.agent.TargetType != target {
+			t.Errorf("BodyString changed TargetType from %q to %q", target, c.agent.TargetType)
+		}
+	}
+}
+
+func TestSerialPerHostOpenBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "page")
+	}))
+	defer ts.Close()
+
+	SerialPerHost(true)
+	defer SerialPerHost(false)
+
+	// the first body is never closed, the host must not stay locked
+	first, errs := New().Get(ts.URL).End()
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer first.Body.Close()
+	done := make(chan struct{})
+	go func() {
+		New().Get(ts.URL).Bytes()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("second request blocked by the open body of the first")
+	}
+}
+
+func TestSerialPerHost(t *testing.T) {
+	var running, overlap int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.StoreInt32(&overlap, 1)
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}))
+	defer ts.Close()
+
+	SerialPerHost(true)
+	defer SerialPerHost(false)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			New().Get(ts.URL).Bytes()
+		}()
+	}
+	wg.Wait()
+	if overlap != 0 {
+		t.Error("requests to the same host overlapped")
+	}
+}
+
+func TestStringCharset(t *testing.T) {
+	// "中文" in GBK
+	gbk := []byte{0xd6, 0xd0, 0xce, 0xc4}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/declared" {
+			w.Header().Set("Content-Type", "text/html; charset=GBK")
+		}
+		w.Write(gbk)
+	}))
+	defer ts.Close()
+
+	for _, c := range []struct{ path, enc string }{{"/declared", ""}, {"/plain", "gbk"}} {
+		body, _, err := New().Get(ts.URL + c.path).StringCharset(c.enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != "中文" {
+			t.Errorf("%s: body = %q", c.path, body)
+		}
+	}
+	if body, _, _ := New().Get(ts.URL + "/plain").StringCharset(""); body != string(gbk) {
+		t.Errorf("unknown charset: body = %q", body)
+	}
+}
+
+func TestIdleConnTimeout(t *testing.T) {
+	shared := GetDefaultTransport()
+	before := shared.IdleConnTimeout
+	transport := New().IdleConnTimeout(30 * time.Second).agentTransport(shared)
+	if transport == shared || transport.IdleConnTimeout != 30*time.Second {
+		t.Errorf("agent transport IdleConnTimeout = %v", transport.IdleConnTimeout)
+	}
+	if shared.IdleConnTimeout != before {
+		t.Error("shared transport was modified")
+	}
+}
+
+func TestAutoAccept(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("Accept"))
+	}))
+	defer ts.Close()
+
+	accept, _, _ := New().AutoAccept(true).Post(ts.URL).Send(`{"a":1}`).String()
+	if accept != "application/json" {
+		t.Errorf("json Accept = %q", accept)
+	}
+	accept, _, _ = New().AutoAccept(true).Post(ts.URL).Type("xml").Send("<a/>").String()
+	if accept != "application/xml" {
+		t.Errorf("xml Accept = %q", accept)
+	}
+	accept, _, _ = New().AutoAccept(true).Post(ts.URL).Type("form").Send("a=1").String()
+	if accept != "" {
+		t.Errorf("form Accept = %q", accept)
+	}
+	accept, _, _ = New().AutoAccept(true).Set("Accept", "text/csv").Post(ts.URL).Send(`{"a":1}`).String()
+	if accept != "text/csv" {
+		t.Errorf("Set Accept = %q", accept)
+	}
+}
+
+func TestSameHostRedirectsOnly(t *testing.T) {
+	var hit int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hit, 1)
+	}))
+	defer other.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/away":
+			http.Redirect(w, r, other.URL+"/", http.StatusFound)
+		case "/here":
+			http.Redirect(w, r, "/done", http.StatusFound)
+		default:
+			io.WriteString(w, "done")
+		}
+	}))
+	defer ts.Close()
+
+	_, errs := New().SameHostRedirectsOnly().Get(ts.URL + "/away").End()
+	var hostErr *RedirectHostError
+	if len(errs) == 0 || !errors.As(errs[0], &hostErr) {
+		t.Fatalf("errs = %v, want a RedirectHostError", errs)
+	}
+	if atomic.LoadInt32(&hit) != 0 {
+		t.Error("the other host was requested")
+	}
+
+	body, _, err := New().SameHostRedirectsOnly().MaxRedirect(3).Get(ts.URL + "/here").String()
+	if err != nil || body != "done" {
+		t.Errorf("same host redirect: body = %q, err = %v", body, err)
+	}
+}
+
+func TestAllowErrorBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/loop")
+		w.WriteHeader(http.StatusFound)
+		io.WriteString(w, "moved")
+	}))
+	defer ts.Close()
+
+	body, code, err := New().MaxRedirect(1).Get(ts.URL).String()
+	if err == nil || body != "" {
+		t.Errorf("without AllowErrorBody: body = %q, err = %v", body, err)
+	}
+
+	body, code, err = New().AllowErrorBody().MaxRedirect(1).Get(ts.URL).String()
+	if err == nil || !strings.Contains(err.Error(), "MaxRedirects reached") {
+		t.Errorf("err = %v, want MaxRedirects reached", err)
+	}
+	if body != "moved" || code != http.StatusFound {
+		t.Errorf("body = %q, code = %d", body, code)
+	}
+}
+
+type countGetter struct {
+	calls int32
+}
+
+func (g *countGetter) GetHttpClient(httpurl string, proxyurl string, usejar bool) (*http.Client, error) {
+	atomic.AddInt32(&g.calls, 1)
+	return &http.Client{Transport: http.DefaultTransport}, nil
+}
+
+func TestClientGetter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer ts.Close()
+
+	agent := &countGetter{}
+	if body, _, err := New().WithGetter(agent).Get(ts.URL).String(); err != nil || body != "ok" {
+		t.Fatalf("WithGetter: body = %q, err = %v", body, err)
+	}
+	if agent.calls != 1 {
+		t.Errorf("agent getter called %d times", agent.calls)
+	}
+
+	global := &countGetter{}
+	SetDefaultGetter(global)
+	defer SetDefaultGetter(nil)
+	New().Get(ts.URL).String()
+	if global.calls != 1 {
+		t.Errorf("default getter called %d times", global.calls)
+	}
+	SetDefaultGetter(nil)
+	if _, ok := GetDefaultGetter().(*IpRollClient); !ok {
+		t.Error("SetDefaultGetter(nil) didn't restore the built-in getter")
+	}
+}
+
+func TestHostBandwidth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("a"), 3000))
+	}))
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+
+	// the first second worth of bytes is the burst, the remaining 1000 take 500ms
+	SetHostBandwidth(host, 2000)
+	defer SetHostBandwidth(host, 0)
+	start := time.Now()
+	body, _, err := New().Get(ts.URL).Bytes()
+	if err != nil || len(body) != 3000 {
+		t.Fatalf("len(body) = %d, err = %v", len(body), err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("body read in %v, want about 500ms", d)
+	}
+}
+
+func TestMultipartBoundary(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %t", params["boundary"], bytes.HasSuffix(body, []byte("--"+params["boundary"]+"--\r\n")))
+	}))
+	defer ts.Close()
+
+	// ':' is allowed in a boundary but must be quoted in Content-Type
+	for _, b := range []string{"fixed-boundary", "my:boundary"} {
+		body, _, err := New().MultipartBoundary(b).Post(ts.URL).Type("multipart").Send("a=1").String()
+		if err != nil || body != b+" true" {
+			t.Errorf("body = %q, err = %v", body, err)
+		}
+	}
+
+	_, errs := New().MultipartBoundary("bad\nboundary").Post(ts.URL).Type("multipart").Send("a=1").End()
+	if errs == nil {
+		t.Error("invalid boundary accepted")
+	}
+}
+
+func TestSendFilePathStreamed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		io.Copy(w, f)
+	}))
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "upload.txt")
+	ioutil.WriteFile(path, []byte("from disk"), 0644)
+
+	s := New().Post(ts.URL).Type("multipart").SendFile(path)
+	if s.FileData[0].Reader != nil || len(s.openFiles) != 0 {
+		t.Fatalf("file opened before End: reader %T, %d open", s.FileData[0].Reader, len(s.openFiles))
+	}
+	for i := 0; i < 2; i++ {
+		body, _, err := s.String()
+		if err != nil || body != "from disk" {
+			t.Errorf("send %d: body = %q, err = %v", i, body, err)
+		}
+		if len(s.openFiles) != 0 {
+			t.Errorf("send %d: %d files still open after End", i, len(s.openFiles))
+		}
+	}
+
+	files, err := s.openFileData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := files[0].Reader.(*os.File); !ok {
+		t.Fatalf("reader is %T, want the opened file", files[0].Reader)
+	}
+	s.closeFiles()
+	if _, err := files[0].Reader.Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("file still open after closeFiles, read err = %v", err)
+	}
+
+	os.Remove(path)
+	if _, errs := s.End(); errs == nil {
+		t.Error("removed file sent without error")
+	}
+}
+
+func TestCloseConnection(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Close)
+	}))
+	defer ts.Close()
+
+	// the shared transport has keep-alive off, every request closes its connection there
+	if body, _, _ := New().KeepAlive(2).Close(true).Get(ts.URL).String(); body != "true" {
+		t.Errorf("Close(true): request Close = %s", body)
+	}
+	if body, _, _ := New().KeepAlive(2).Get(ts.URL).String(); body != "false" {
+		t.Errorf("keep-alive: request Close = %s", body)
+	}
+}
+
+func TestBytesHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/items/1")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusCreated)
+		gz := gzip.NewWriter(w)
+		io.WriteString(gz, "created")
+		gz.Close()
+	}))
+	defer ts.Close()
+
+	body, header, code, err := New().Set("Accept-Encoding", "gzip").Post(ts.URL).BytesHeaders(http.StatusCreated)
+	if err != nil || string(body) != "created" || code != http.StatusCreated {
+		t.Fatalf("body = %q, code = %d, err = %v", body, code, err)
+	}
+	if header.Get("Location") != "/items/1" {
+		t.Errorf("Location = %q", header.Get("Location"))
+	}
+}
+
+func TestSendFileImpliesMultipart(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content, _ := ioutil.ReadAll(f)
+		fmt.Fprintf(w, "%s %s %s", r.FormValue("name"), header.Filename, content)
+	}))
+	defer ts.Close()
+
+	body, _, err := New().Post(ts.URL).
+		Send(map[string]string{"name": "report"}).
+		SendFile([]byte("data"), "report.txt").
+		String()
+	if err != nil || body != "report report.txt data" {
+		t.Errorf("body = %q, err = %v", body, err)
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stall" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer ts.Close()
+
+	s := New().ResponseHeaderTimeout(50 * time.Millisecond)
+	start := time.Now()
+	if _, _, err := s.Get(ts.URL + "/stall").String(); err == nil || time.Since(start) > 250*time.Millisecond {
+		t.Errorf("stalled request: err = %v after %v", err, time.Since(start))
+	}
+	if body, _, err := s.Get(ts.URL).String(); err != nil || body != "ok" {
+		t.Errorf("body = %q, err = %v", body, err)
+	}
+}
+
+func TestOrderedQuery(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.RawQuery)
+	}))
+	defer ts.Close()
+
+	query, _, err := New().OrderedQuery().Get(ts.URL+"?z=0").
+		Param("timestamp", "1").
+		Query("b=2&a=3").
+		Param("timestamp", "4").
+		SetParam("b", "5").
+		Param("sign", "x y").
+		String()
+	if want := "z=0&timestamp=1&timestamp=4&b=5&a=3&sign=x+y"; err != nil || query != want {
+		t.Errorf("query = %q, want %q (err %v)", query, want, err)
+	}
+
+	query, _, _ = New().Get(ts.URL).Param("b", "1").Param("a", "2").String()
+	if query != "a=2&b=1" {
+		t.Errorf("default query = %q, want sorted", query)
+	}
+}
+
+func TestOnRedirect(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, "/c", http.StatusFound)
+		default:
+			io.WriteString(w, r.Header.Get("X-Hop"))
+		}
+	}))
+	defer ts.Close()
+
+	var hops []string
+	body, _, err := New().
+		OnRedirect(func(req *http.Request, via []*http.Request) error {
+			hops = append(hops, req.URL.Path)
+			req.Header.Set("X-Hop", strconv.Itoa(len(via)))
+			return nil
+		}).
+		Get(ts.URL + "/a").
+		String()
+	if err != nil || body != "2" || strings.Join(hops, ",") != "/b,/c" {
+		t.Errorf("body = %q, hops = %v, err = %v", body, hops, err)
+	}
+
+	stop := errors.New("stop")
+	_, errs := New().
+		OnRedirect(func(req *http.Request, via []*http.Request) error { return stop }).
+		Get(ts.URL + "/a").
+		End()
+	if len(errs) == 0 || !errors.Is(errs[0], stop) {
+		t.Errorf("errs = %v, want the error of OnRedirect", errs)
+	}
+}
+
+func TestWithOptionAddress(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie("session"); err != nil {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", Path: "/"})
+			io.WriteString(w, "new")
+			return
+		}
+		io.WriteString(w, "known")
+	}))
+	defer ts.Close()
+
+	s := New().WithOption(&Option{Address: []string{"127.0.0.1"}})
+	for _, want := range []string{"new", "known"} {
+		if body, _, err := s.Get(ts.URL).String(); err != nil || body != want {
+			t.Fatalf("body = %q, err = %v, want %q", body, err, want)
+		}
+	}
+	if n := s.optionGetter.(*IpRollClient).Stats().IPRequests["127.0.0.1"]; n != 2 {
+		t.Errorf("requests from 127.0.0.1 = %d, want 2", n)
+	}
+
+	ResetCookie(ts.URL)
+	if body, _, _ := s.Get(ts.URL).String(); body != "new" {
+		t.Errorf("ResetCookie missed the jar of the agent's options, body = %q", body)
+	}
+
+	for i := 0; i <= maxOptionClients; i++ {
+		New().WithOption(&Option{Agent: fmt.Sprintf("agent %d", i)})
+	}
+	if n := len(getOptionClients()); n > maxOptionClients {
+		t.Errorf("%d getters kept, want at most %d", n, maxOptionClients)
+	}
+}
+
+func TestWithOption(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.UserAgent())
+	}))
+	defer ts.Close()
+
+	polite := New().WithOption(&Option{Agent: "polite", Delay: 150 * time.Millisecond})
+	if ua, _, err := polite.Get(ts.URL).String(); err != nil || ua != "polite" {
+		t.Fatalf("User-Agent = %q, err = %v", ua, err)
+	}
+	start := time.Now()
+	polite.Get(ts.URL).String()
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("second request after %v, want the delay of the agent's options", d)
+	}
+
+	start = time.Now()
+	New().Get(ts.URL).String()
+	ua, _, _ := New().Get(ts.URL).String()
+	if ua != GetOption().Agent || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("default agent: User-Agent = %q after %v", ua, time.Since(start))
+	}
+}
+
+func TestTypeBodyMismatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	mismatches := map[string]*HttpAgent{
+		"stream": New().Post(ts.URL).Type("stream").Send(`{"a":1}`),
+		"text":   New().Post(ts.URL).Send(`{"a":1}`).Type("text"),
+		"xml":    New().Post(ts.URL).SendBytes([]byte("<a/>")).Type("xml"),
+		"method": New().Post(ts.URL),
+		"url":    New().Post("http://[::1").Send(`{"a":1}`),
+	}
+	mismatches["method"].Method = "OPTIONS"
+	for name, s := range mismatches {
+		if _, errs := s.End(); len(errs) == 0 {
+			t.Errorf("%s: no error", name)
+		}
+	}
+
+	if body, _, err := New().Post(ts.URL).Type("text").String(); err != nil || body != "" {
+		t.Errorf("empty text body = %q, err = %v", body, err)
+	}
+}
+
+func TestRawQuery(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.RawQuery)
+	}))
+	defer ts.Close()
+
+	query, _, err := New().Get(ts.URL+"?x=1").Param("y", "2").RawQuery("z=a%20b&c=d").String()
+	if err != nil || query != "z=a%20b&c=d" {
+		t.Errorf("query = %q, err = %v", query, err)
+	}
+}
+
+func TestBearerSource(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer ts.Close()
+
+	// a cache handing out its token until the server refuses it
+	var n int32
+	tokens := func(refresh bool) (string, error) {
+		if refresh || atomic.LoadInt32(&n) == 0 {
+			atomic.AddInt32(&n, 1)
+		}
+		return fmt.Sprintf("token-%d", atomic.LoadInt32(&n)), nil
+	}
+	policy := DefaultRetryPolicy()
+	policy.BaseDelay = time.Millisecond
+	retry := policy.RetryStatus
+	policy.RetryStatus = func(code int) bool { return code == http.StatusUnauthorized || retry(code) }
+	body, code, err := New().BearerSource(tokens).SetRetryPolicy(policy).Get(ts.URL).String()
+	if err != nil || code != http.StatusOK || body != "ok" {
+		t.Errorf("body = %q, code = %d, err = %v", body, code, err)
+	}
+
+	fail := errors.New("no token")
+	_, errs := New().BearerSource(func(bool) (string, error) { return "", fail }).Get(ts.URL).End()
+	if len(errs) == 0 || errs[0] != fail {
+		t.Errorf("errs = %v, want the error of the token source", errs)
+	}
+
+	// the token source failing before a retry
+	atomic.StoreInt32(&n, 0)
+	once := func(bool) (string, error) {
+		if atomic.AddInt32(&n, 1) > 1 {
+			return "", fail
+		}
+		return "token-1", nil
+	}
+	_, errs = New().BearerSource(once).SetRetryPolicy(policy).Get(ts.URL).End()
+	if len(errs) == 0 || !errors.Is(errs[0], fail) {
+		t.Errorf("errs = %v, want the error of the token source on retry", errs)
+	}
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("Authorization"))
+	}))
+	defer other.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(other.URL, http.StatusFound))
+	defer redirect.Close()
+	body, _, _ = New().MaxRedirect(5).Set("Authorization", "Bearer secret").Get(redirect.URL).String()
+	if body != "" {
+		t.Errorf("Authorization sent to another host on redirect: %q", body)
+	}
+}
@@ -2,34 +2,52 @@ package gohttp
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
 type MultipartStreamer struct {
 	ContentType   string
+	subtype       string
 	bodyBuffer    *bytes.Buffer
 	bodyWriter    *multipart.Writer
 	closeBuffer   *bytes.Buffer
-	reader        io.Reader
+	files         []streamFile
 	contentLength int64
+	// root is the media type of the first part of a multipart/related body
+	root string
+}
+
+// streamFile is a file part: the bytes written before it, its header included, then its content.
+type streamFile struct {
+	head   []byte
+	reader io.Reader
 }
 
 // New initializes a new MultipartStreamer.
 func NewMultiPartStreamer() (m *MultipartStreamer) {
-	m = &MultipartStreamer{bodyBuffer: new(bytes.Buffer)}
+	return NewMultiPartStreamerType("form-data")
+}
+
+// NewMultiPartStreamerType initializes a new MultipartStreamer of the given subtype, like "related" or "mixed".
+// Parts of a subtype other than "form-data" carry no Content-Disposition, only a Content-Type.
+func NewMultiPartStreamerType(subtype string) (m *MultipartStreamer) {
+	m = &MultipartStreamer{bodyBuffer: new(bytes.Buffer), subtype: subtype}
 
 	m.bodyWriter = multipart.NewWriter(m.bodyBuffer)
 	boundary := m.bodyWriter.Boundary()
-	m.ContentType = "multipart/form-data; boundary=" + boundary
+	m.setContentType()
 
 	closeBoundary := fmt.Sprintf("\r\n--%s--\r\n", boundary)
 	m.closeBuffer = bytes.NewBufferString(closeBoundary)
@@ -37,12 +55,55 @@ func NewMultiPartStreamer() (m *MultipartStreamer) {
 	return
 }
 
+// SetBoundary replaces the random boundary with b, for a body that is the same across runs or for servers
+// expecting a given boundary. It must be called before any part is written. b must follow RFC 2046:
+// 1 to 70 characters among letters, digits and '()+_,-./:=? ' (space), not ending with a space.
+func (m *MultipartStreamer) SetBoundary(b string) error {
+	if m.bodyBuffer.Len() > 0 || len(m.files) > 0 {
+		return errors.New("multipart: SetBoundary called after write")
+	}
+	if err := m.bodyWriter.SetBoundary(b); err != nil {
+		return err
+	}
+	m.setContentType()
+	m.closeBuffer = bytes.NewBufferString(fmt.Sprintf("\r\n--%s--\r\n", b))
+	return nil
+}
+
+// setContentType sets the Content-Type of the body from its boundary, and for multipart/related
+// from the type of its root part too, which RFC 2387 requires.
+func (m *MultipartStreamer) setContentType() {
+	params := map[string]string{"boundary": m.bodyWriter.Boundary()}
+	if m.root != "" {
+		params["type"] = m.root
+	}
+	m.ContentType = mime.FormatMediaType("multipart/"+m.subtype, params)
+}
+
+// addRoot records ctype as the type of the root part when it is the first part of a multipart/related body.
+func (m *MultipartStreamer) addRoot(ctype string) {
+	if m.subtype != "related" || m.root != "" {
+		return
+	}
+	if mt, _, err := mime.ParseMediaType(ctype); err == nil {
+		m.root = mt
+		m.setContentType()
+	}
+}
+
 // WriteFields writes multiple form fields to the multipart.Writer.
+// Fields are written sorted by key so the body is the same across runs.
 func (m *MultipartStreamer) WriteFields(fields url.Values) error {
 	var err error
 
-	for key, values := range fields {
-		for _, value := range values {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		for _, value := range fields[key] {
 			err = m.bodyWriter.WriteField(key, value)
 			if err != nil {
 				return err
@@ -53,26 +114,68 @@ func (m *MultipartStreamer) WriteFields(fields url.Values) error {
 	return nil
 }
 
+// WriteFieldWithType writes a form field whose part carries a Content-Type, like a json metadata field.
+func (m *MultipartStreamer) WriteFieldWithType(key, value, ctype string) error {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"`, escapeQuotes(key)))
+	h.Set("Content-Type", ctype)
+	w, err := m.bodyWriter.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, value)
+	return err
+}
+
 // WriteReader adds an io.Reader to get the content of a file.  The reader is
 // not accessed until the multipart.Reader is copied to some output writer.
 // func (m *MultipartStreamer) WriteReader(key, filename string, size int64, reader io.Reader, ctype string) (err error) {
+// Several files can be written, each one is streamed in turn.
 func (m *MultipartStreamer) WriteReader(f File) (err error) {
-	m.reader = f.Reader
-	m.contentLength = f.Len
-
-	if f.ContentType == "" {
-		_, err = m.bodyWriter.CreateFormFile(f.Fieldname, f.Filename)
-	} else {
-		h := make(textproto.MIMEHeader)
+	h := make(textproto.MIMEHeader)
+	if m.subtype == "form-data" {
 		h.Set("Content-Disposition",
 			fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
 				escapeQuotes(f.Fieldname), escapeQuotes(f.Filename)))
-		h.Set("Content-Type", f.ContentType)
-		m.bodyWriter.CreatePart(h)
+	}
+	ctype := f.ContentType
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	h.Set("Content-Type", ctype)
+	m.addRoot(ctype)
+	for k, v := range f.Header {
+		h.Set(k, v)
+	}
+	if _, err = m.bodyWriter.CreatePart(h); err != nil {
+		return
+	}
+
+	// what was written so far goes before the file, what comes next after it
+	head := append([]byte(nil), m.bodyBuffer.Bytes()...)
+	m.bodyBuffer.Reset()
+	m.files = append(m.files, streamFile{head, f.Reader})
+	if f.Len < 0 || m.contentLength < 0 {
+		m.contentLength = -1
+	} else {
+		m.contentLength += f.Len
 	}
 	return
 }
 
+// WritePart writes a part holding data with the given Content-Type, like the json metadata of a multipart/related body.
+func (m *MultipartStreamer) WritePart(ctype string, data []byte) error {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", ctype)
+	m.addRoot(ctype)
+	w, err := m.bodyWriter.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
 // WriteFile is a shortcut for adding a local file as an io.Reader.
 func (m *MultipartStreamer) WriteFile(key, filename string) error {
 	fh, err := os.Open(filename)
@@ -82,6 +185,7 @@ func (m *MultipartStreamer) WriteFile(key, filename string) error {
 
 	stat, err := fh.Stat()
 	if err != nil {
+		fh.Close()
 		return err
 	}
 
@@ -95,29 +199,72 @@ func (m *MultipartStreamer) WriteFile(key, filename string) error {
 }
 
 // SetupRequest sets up the http.Request body, and some crucial HTTP headers.
+// When the file reader can be rewound, GetBody is set too, so the body is replayed on 307/308 redirects.
 func (m *MultipartStreamer) SetupRequest(req *http.Request) {
+	if getBody := m.getBody(); getBody != nil {
+		req.GetBody = getBody
+	}
 	req.Body = m.GetReader()
 	req.Header.Set("Content-Type", m.ContentType)
-	req.ContentLength = m.Len()
+	if n := m.Len(); n >= 0 {
+		req.ContentLength = n
+	} else {
+		// the file size is unknown, send it chunked
+		req.ContentLength = 0
+		req.TransferEncoding = []string{"chunked"}
+	}
+}
+
+// getBody returns a function producing a fresh copy of the body, or nil if a file reader can't be rewound.
+func (m *MultipartStreamer) getBody() func() (io.ReadCloser, error) {
+	seekers := make([]io.Seeker, len(m.files))
+	for i, f := range m.files {
+		s, ok := f.reader.(io.Seeker)
+		if !ok {
+			return nil
+		}
+		seekers[i] = s
+	}
+
+	files := append([]streamFile(nil), m.files...)
+	tail := append(append([]byte(nil), m.bodyBuffer.Bytes()...), m.closeBuffer.Bytes()...)
+	return func() (io.ReadCloser, error) {
+		readers := make([]io.Reader, 0, 2*len(files)+1)
+		for i, f := range files {
+			if _, err := seekers[i].Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			readers = append(readers, bytes.NewReader(f.head), f.reader)
+		}
+		readers = append(readers, bytes.NewReader(tail))
+		return ioutil.NopCloser(io.MultiReader(readers...)), nil
+	}
 }
 
 func (m *MultipartStreamer) Boundary() string {
 	return m.bodyWriter.Boundary()
 }
 
-// Len calculates the byte size of the multipart content.
+// Len calculates the byte size of the multipart content, -1 when the size of a file is unknown.
 func (m *MultipartStreamer) Len() int64 {
-	return m.contentLength + int64(m.bodyBuffer.Len()) + int64(m.closeBuffer.Len())
+	if m.contentLength < 0 {
+		return -1
+	}
+	n := m.contentLength + int64(m.bodyBuffer.Len()) + int64(m.closeBuffer.Len())
+	for _, f := range m.files {
+		n += int64(len(f.head))
+	}
+	return n
 }
 
 // GetReader gets an io.ReadCloser for passing to an http.Request.
 func (m *MultipartStreamer) GetReader() io.ReadCloser {
-	if m.reader == nil {
-		reader := io.MultiReader(m.bodyBuffer, m.closeBuffer)
-		return ioutil.NopCloser(reader)
+	readers := make([]io.Reader, 0, 2*len(m.files)+2)
+	for _, f := range m.files {
+		readers = append(readers, bytes.NewReader(f.head), f.reader)
 	}
-	reader := io.MultiReader(m.bodyBuffer, m.reader, m.closeBuffer)
-	return ioutil.NopCloser(reader)
+	readers = append(readers, m.bodyBuffer, m.closeBuffer)
+	return ioutil.NopCloser(io.MultiReader(readers...))
 }
 
 var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
@@ -0,0 +1,71 @@
+package gohttp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+)
+
+// Response is a response whose body was read once and kept, decompressed.
+// Its accessors can be called any number of times, in any order.
+type Response struct {
+	resp *http.Response
+	body []byte
+}
+
+// Do sends the request and reads the whole response, whatever its status:
+//
+//      resp, err := gohttp.New().Get("http://example.com/api/user").Do()
+//      if err != nil {
+//        return err
+//      }
+//      if resp.StatusCode() == http.StatusOK {
+//        err = resp.JSON(&user)
+//      }
+//
+func (s *HttpAgent) Do() (*Response, error) {
+	resp, reader, _, err := s.openBody()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return &Response{resp: resp, body: body}, nil
+}
+
+// Raw returns the underlying http.Response, its Body reads the decoded body again.
+func (r *Response) Raw() *http.Response {
+	return r.resp
+}
+
+func (r *Response) StatusCode() int {
+	return r.resp.StatusCode
+}
+
+// Header returns the first value of the response header k.
+func (r *Response) Header(k string) string {
+	return r.resp.Header.Get(k)
+}
+
+// Cookies returns the cookies set by the response.
+func (r *Response) Cookies() []*http.Cookie {
+	return r.resp.Cookies()
+}
+
+func (r *Response) Bytes() []byte {
+	return r.body
+}
+
+func (r *Response) String() string {
+	return string(r.body)
+}
+
+// JSON decodes the body into v, numbers into interface{} values become json.Number.
+func (r *Response) JSON(v interface{}) error {
+	return json_unmarshal(r.body, v)
+}
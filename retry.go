@@ -0,0 +1,175 @@
+package gohttp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy tells End whether a failed request is sent again and how long to wait before.
+// The wait after attempt n is BaseDelay * Multiplier^(n-1), capped at MaxDelay, then moved
+// at random by up to Jitter (a fraction, 0.2 means ±20%) so that clients don't retry in lockstep.
+type RetryPolicy struct {
+	// MaxAttempts counts the first try, 1 or less never retries
+	MaxAttempts int
+	BaseDelay   time.Duration
+	Multiplier  float64
+	MaxDelay    time.Duration
+	Jitter      float64
+	// RetryStatus reports whether a response with this status is retried, nil never retries on status
+	RetryStatus func(code int) bool
+	// RetryError reports whether a transport error is retried, nil never retries on error
+	RetryError func(err error) bool
+	// AnyMethod retries requests that aren't idempotent too, a POST without an IdempotencyKey
+	// may then be applied twice by the server. By default only idempotent requests are retried.
+	AnyMethod bool
+}
+
+// DefaultRetryPolicy tries 3 times, waiting 200ms then 400ms (±20%, at most 5s),
+// on transport errors and on 429, 502, 503 and 504 responses. Like any policy without AnyMethod,
+// it only retries idempotent requests: a GET, HEAD, OPTIONS, PUT or DELETE, or a request with an IdempotencyKey.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   200 * time.Millisecond,
+		Multiplier:  2,
+		MaxDelay:    5 * time.Second,
+		Jitter:      0.2,
+		RetryStatus: func(code int) bool {
+			return statusIn(code, []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout})
+		},
+		RetryError: func(err error) bool {
+			return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+		},
+	}
+}
+
+// SetRetryPolicy makes End send the request again as the policy says. The whole body is sent again
+// on each attempt, requests whose body can't be replayed (a plain io.Reader given to SetBody) are sent once.
+// Attempts stop as soon as the context or the TotalTimeout is done. Without a policy, an idempotent
+// request is still sent a second time when its connection is reset:
+//
+//      policy := gohttp.DefaultRetryPolicy()
+//      policy.MaxAttempts = 5
+//
+//      gohttp.New().
+//        SetRetryPolicy(policy).
+//        Get("https://api.example.com/status").
+//        End()
+//
+func (s *HttpAgent) SetRetryPolicy(p RetryPolicy) *HttpAgent {
+	s.Retry = &p
+	return s
+}
+
+// shouldRetry reports whether the outcome of attempt is worth another attempt.
+func (p *RetryPolicy) shouldRetry(attempt int, resp *http.Response, err error) bool {
+	if p == nil || attempt >= p.MaxAttempts {
+		return false
+	}
+	if err != nil {
+		return p.RetryError != nil && p.RetryError(err)
+	}
+	return p.RetryStatus != nil && p.RetryStatus(resp.StatusCode)
+}
+
+// backoff returns the wait after attempt, counted from 1.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.BaseDelay)
+	for i := 1; i < attempt && p.Multiplier > 0; i++ {
+		d *= p.Multiplier
+		if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+			break
+		}
+	}
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(d)
+}
+
+// resetRetry is used without a retry policy: a request that is safe to repeat
+// is sent once more, right away, when its connection was reset or closed early.
+var resetRetry = &RetryPolicy{MaxAttempts: 2, RetryError: isConnReset}
+
+// isConnReset reports whether err is a connection reset by the peer or closed before the response.
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		strings.Contains(err.Error(), "connection reset by peer")
+}
+
+// idempotent reports whether req can be sent twice safely: its method is idempotent by RFC 9110,
+// GET, HEAD, OPTIONS, TRACE, PUT or DELETE, or it carries an idempotency key.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case GET, HEAD, PUT, DELETE, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// doRetry sends req with client, sending it again while the agent's retry policy asks for it.
+// Without a policy, idempotent requests are retried once on a connection reset.
+func (s *HttpAgent) doRetry(client *http.Client, req *http.Request) (*http.Response, error) {
+	policy := s.Retry
+	if policy == nil && idempotent(req) {
+		policy = resetRetry
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Do(req)
+		reportHost(req.URL.Host, err == nil && resp.StatusCode < 500)
+
+		if !policy.shouldRetry(attempt, resp, err) || (req.Body != nil && req.GetBody == nil) ||
+			!(policy.AnyMethod || idempotent(req)) {
+			return resp, err
+		}
+
+		ctx := req.Context()
+		timer := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return resp, err
+		case <-timer.C:
+		}
+
+		next := req.Clone(ctx)
+		if s.TokenFn != nil {
+			token, terr := s.TokenFn(err == nil && resp.StatusCode == http.StatusUnauthorized)
+			if terr != nil {
+				if resp != nil {
+					resp.Body.Close()
+				}
+				return nil, terr
+			}
+			next.Header.Set("Authorization", "Bearer "+token)
+		}
+		if req.GetBody != nil {
+			body, berr := req.GetBody()
+			if berr != nil {
+				return resp, err
+			}
+			next.Body = body
+		}
+		if aerr := allowHost(req.URL.Host); aerr != nil {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		req = next
+	}
+}
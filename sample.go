@@ -0,0 +1,104 @@
+package gohttp
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// RequestLog describes a request picked by the sample logger.
+type RequestLog struct {
+	Method string
+	URL    string
+	// StatusCode is 0 when no response was received
+	StatusCode int
+	Duration   time.Duration
+	// SourceIP is the local address the connection went out from, one of Option.Address when set
+	SourceIP string
+	// Proxy is the proxy the request went through, "" when direct
+	Proxy string
+	Err   error
+}
+
+var sampleLock sync.RWMutex
+var sampleRate float64
+var sampleLogger func(RequestLog)
+
+// SetSampleLogger logs a random share of the requests: each request is passed to logger with probability rate,
+// from 0 (never, the default) to 1 (always). It checks in production how traffic spreads across the
+// source ips without flooding the logs:
+//
+//      gohttp.SetSampleLogger(0.01, func(info gohttp.RequestLog) {
+//        log.Printf("%s %s %d %v via %s", info.Method, info.URL, info.StatusCode, info.Duration, info.SourceIP)
+//      })
+//
+// A nil logger turns sampling off.
+func SetSampleLogger(rate float64, logger func(info RequestLog)) {
+	defer sampleLock.Unlock()
+	sampleLock.Lock()
+
+	sampleRate = rate
+	sampleLogger = logger
+}
+
+// requestSample collects the log of a sampled request.
+type requestSample struct {
+	logger func(RequestLog)
+	start  time.Time
+	lock   sync.Mutex
+	source string
+}
+
+// newRequestSample draws whether this request is logged, it returns nil when not.
+func newRequestSample() *requestSample {
+	sampleLock.RLock()
+	rate, logger := sampleRate, sampleLogger
+	sampleLock.RUnlock()
+
+	if logger == nil || rate <= 0 || rand.Float64() >= rate {
+		return nil
+	}
+	return &requestSample{logger: logger, start: time.Now()}
+}
+
+// trace records the local address of the connections used under ctx.
+func (r *requestSample) trace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr, ok := info.Conn.LocalAddr().(*net.TCPAddr); ok {
+				r.lock.Lock()
+				r.source = addr.IP.String()
+				r.lock.Unlock()
+			}
+		},
+	})
+}
+
+// log hands the outcome of req to the logger. proxy is the proxy set on the agent, when empty
+// the one the transport picks for req is reported.
+func (r *requestSample) log(req *http.Request, proxy string, transport *http.Transport, resp *http.Response, err error) {
+	if proxy == "" && transport != nil && transport.Proxy != nil {
+		if u, _ := transport.Proxy(req); u != nil {
+			proxy = u.String()
+		}
+	}
+	info := RequestLog{
+		Method:   req.Method,
+		URL:      req.URL.String(),
+		Duration: time.Since(r.start),
+		Proxy:    proxy,
+		Err:      err,
+	}
+	if resp != nil {
+		info.StatusCode = resp.StatusCode
+	}
+	r.lock.Lock()
+	info.SourceIP = r.source
+	r.lock.Unlock()
+
+	r.logger(info)
+}
@@ -0,0 +1,280 @@
+package gohttp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// NoProxy makes this agent ignore the HTTP_PROXY/HTTPS_PROXY environment variables.
+// A proxy set explicitly with Proxy is still used.
+func (s *HttpAgent) NoProxy() *HttpAgent {
+	s.IgnoreEnvProxy = true
+	s.resetTransports()
+	return s
+}
+
+// ProxyFunc sets the function choosing the proxy of each request of this agent, for a rotating proxy pool
+// where the proxy changes per request. A proxy set with Proxy still wins.
+func (s *HttpAgent) ProxyFunc(fn func(*http.Request) (*url.URL, error)) *HttpAgent {
+	s.ProxyFn = fn
+	s.resetTransports()
+	return s
+}
+
+// Resolve makes this agent connect to ip whenever it dials host, bypassing DNS.
+// Only the destination address changes, the Host header and TLS SNI still use host:
+//
+//      gohttp.New().
+//        Resolve("api.example.com", "10.0.0.12").
+//        Get("https://api.example.com/status").
+//        End()
+//
+func (s *HttpAgent) Resolve(host string, ip string) *HttpAgent {
+	if s.ResolveMap == nil {
+		s.ResolveMap = make(map[string]string)
+	}
+	s.ResolveMap[host] = ip
+	s.resetTransports()
+	return s
+}
+
+// RawBody turns off all decompression for this agent. The transport no longer decompresses gzip transparently
+// and Bytes, String and the other helpers hand back the body as received, with its Content-Encoding.
+// Accept-Encoding is set to gzip unless set with Set.
+func (s *HttpAgent) RawBody() *HttpAgent {
+	s.RawResponse = true
+	s.resetTransports()
+	return s
+}
+
+// KeepAlive enables keep-alive connections for this agent, keeping up to idleConns idle connections per host,
+// whatever Option.MaxIdleConns is. Successive requests of the agent then reuse their connections.
+// An idleConns <= 0 uses http.DefaultMaxIdleConnsPerHost.
+func (s *HttpAgent) KeepAlive(idleConns int) *HttpAgent {
+	if idleConns <= 0 {
+		idleConns = http.DefaultMaxIdleConnsPerHost
+	}
+	s.KeepAliveConns = idleConns
+	s.resetTransports()
+	return s
+}
+
+// Network pins the address family of the connections of this agent: "tcp4" for IPv4 only, "tcp6" for IPv6 only,
+// or "tcp", the default, for whatever the destination resolves to. Handy against dual-stack hosts
+// that behave differently over v4 and v6.
+func (s *HttpAgent) Network(n string) *HttpAgent {
+	switch n {
+	case "tcp", "tcp4", "tcp6":
+		s.DialNetwork = n
+		s.resetTransports()
+	default:
+		s.Errors = append(s.Errors, errors.New("Network func: unsupported network \""+n+"\""))
+	}
+	return s
+}
+
+// ConfigureTransport lets fn adjust the transport of this agent, for settings without a method of their own:
+//
+//      gohttp.New().
+//        ConfigureTransport(func(t *http.Transport) {
+//          t.ResponseHeaderTimeout = 5 * time.Second
+//          t.ExpectContinueTimeout = time.Second
+//        }).
+//        Get("http://example.com/slow").
+//        End()
+//
+// fn gets the agent's own copy of the shared transport, after the other settings of the agent are applied,
+// and runs again only when that copy has to be rebuilt. It replaces the function of a previous call.
+func (s *HttpAgent) ConfigureTransport(fn func(*http.Transport)) *HttpAgent {
+	s.TransportFn = fn
+	s.resetTransports()
+	return s
+}
+
+// Expect100Continue sends requests with a body with "Expect: 100-continue": the headers go first and the body
+// is only streamed once the server answers 100 Continue, or after a second without answer. A server
+// refusing the request, with a 401 for example, does so before a large upload is sent for nothing.
+func (s *HttpAgent) Expect100Continue() *HttpAgent {
+	s.ContinueTimeout = time.Second
+	s.resetTransports()
+	return s
+}
+
+// IdleConnTimeout closes the idle connections of this agent after d without use, before they go stale
+// behind a load balancer. Only the agent's own copy of the transport is changed.
+func (s *HttpAgent) IdleConnTimeout(d time.Duration) *HttpAgent {
+	s.IdleTimeout = d
+	s.resetTransports()
+	return s
+}
+
+// ResponseHeaderTimeout fails a request whose response headers take longer than d to arrive once it is sent,
+// for servers accepting connections then stalling. Reading the body is not limited, a large download
+// that is slow but steady goes through.
+func (s *HttpAgent) ResponseHeaderTimeout(d time.Duration) *HttpAgent {
+	s.HeaderTimeout = d
+	s.resetTransports()
+	return s
+}
+
+// MaxIdleConns sets how many idle connections per host the transport of this agent keeps, whatever
+// Option.MaxIdleConns is. As with Option.MaxIdleConns, 0 turns keep-alive off. The shared transport is left alone.
+func (s *HttpAgent) MaxIdleConns(n int) *HttpAgent {
+	if n <= 0 {
+		// negative tells agentTransport to turn keep-alive off
+		s.KeepAliveConns = -1
+	} else {
+		s.KeepAliveConns = n
+	}
+	s.resetTransports()
+	return s
+}
+
+// hasTransportOptions reports whether the agent needs its own copy of the shared transport.
+func (s *HttpAgent) hasTransportOptions() bool {
+	return (s.IgnoreEnvProxy && s.ProxyUrl == "") || (s.ProxyFn != nil && s.ProxyUrl == "") || len(s.ResolveMap) > 0 || s.RawResponse || s.KeepAliveConns != 0 || s.ContinueTimeout > 0 || s.IdleTimeout > 0 || s.HeaderTimeout > 0 || s.TlsConfig != nil || s.serverName != "" || s.TransportFn != nil ||
+		(s.DialNetwork != "" && s.DialNetwork != "tcp")
+}
+
+func (s *HttpAgent) resetTransports() {
+	s.transportLock.Lock()
+	s.transports = nil
+	s.transportLock.Unlock()
+}
+
+// ResetClient drops the client cached by NewSingle, so the next End gets a fresh one from the client getter,
+// with the current proxy and ip settings. The connections kept by the agent's own transport are closed too.
+// With NewSingle the client is otherwise built once, on the first End, and reused until the agent goes away.
+func (s *HttpAgent) ResetClient() *HttpAgent {
+	s.Client = nil
+	s.transportLock.Lock()
+	for _, t := range s.transports {
+		t.CloseIdleConnections()
+	}
+	s.transports = nil
+	s.transportLock.Unlock()
+	return s
+}
+
+// agentTransport returns the transport this agent sends its request with.
+// When the agent carries transport settings of its own, the shared transport is cloned
+// and the copy is kept, so the shared one is never modified and connections of the copy can be reused.
+func (s *HttpAgent) agentTransport(base *http.Transport) *http.Transport {
+	if base == nil || !s.hasTransportOptions() {
+		return base
+	}
+
+	s.transportLock.Lock()
+	defer s.transportLock.Unlock()
+
+	// a cached copy is only good while the agent keeps the same TLS config
+	if t, ok := s.transports[base]; ok {
+		if s.transportTLS == s.TlsConfig {
+			return t
+		}
+		delete(s.transports, t)
+		t.CloseIdleConnections()
+	}
+
+	t := base.Clone()
+	if s.TlsConfig != nil {
+		config := s.TlsConfig
+		// keep resuming sessions through the cache of Option.TLSSessionCache
+		if config.ClientSessionCache == nil && base.TLSClientConfig != nil && base.TLSClientConfig.ClientSessionCache != nil {
+			config = config.Clone()
+			config.ClientSessionCache = base.TLSClientConfig.ClientSessionCache
+		}
+		t.TLSClientConfig = config
+	}
+	if s.serverName != "" {
+		config := &tls.Config{}
+		if t.TLSClientConfig != nil {
+			config = t.TLSClientConfig.Clone()
+		}
+		config.ServerName = s.serverName
+		t.TLSClientConfig = config
+	}
+	if s.ProxyUrl == "" {
+		if s.ProxyFn != nil {
+			t.Proxy = s.ProxyFn
+		} else if s.IgnoreEnvProxy {
+			t.Proxy = nil
+		}
+	}
+	if s.RawResponse {
+		t.DisableCompression = true
+	}
+	if s.KeepAliveConns > 0 {
+		t.DisableKeepAlives = false
+		t.MaxIdleConnsPerHost = s.KeepAliveConns
+	} else if s.KeepAliveConns < 0 {
+		t.DisableKeepAlives = true
+		t.MaxIdleConnsPerHost = 0
+	}
+	if len(s.ResolveMap) > 0 {
+		t.DialContext = resolveDialContext(t.DialContext, s.ResolveMap)
+	}
+	if s.ContinueTimeout > 0 {
+		t.ExpectContinueTimeout = s.ContinueTimeout
+	}
+	if s.IdleTimeout > 0 {
+		t.IdleConnTimeout = s.IdleTimeout
+	}
+	if s.HeaderTimeout > 0 {
+		t.ResponseHeaderTimeout = s.HeaderTimeout
+	}
+	if s.DialNetwork != "" && s.DialNetwork != "tcp" {
+		t.DialContext = networkDialContext(t.DialContext, s.DialNetwork)
+	}
+	if s.TransportFn != nil {
+		s.TransportFn(t)
+	}
+
+	// proxy transports are built per request, no need to keep them
+	if s.ProxyUrl == "" {
+		if s.transports == nil {
+			s.transports = make(map[*http.Transport]*http.Transport)
+		}
+		s.transports[base] = t
+		s.transports[t] = t
+		s.transportTLS = s.TlsConfig
+	}
+	return t
+}
+
+// resolveDialContext wraps dial so that hosts found in resolve are dialed at the mapped ip.
+func resolveDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error), resolve map[string]string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: GetOption().ConnectTimeout}).DialContext
+	}
+	hosts := make(map[string]string, len(resolve))
+	for host, ip := range resolve {
+		hosts[host] = ip
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			if ip, ok := hosts[host]; ok {
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// networkDialContext wraps dial so that tcp connections use network, tcp4 or tcp6.
+func networkDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error), network string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: GetOption().ConnectTimeout}).DialContext
+	}
+	return func(ctx context.Context, n, addr string) (net.Conn, error) {
+		if n == "tcp" {
+			n = network
+		}
+		return dial(ctx, n, addr)
+	}
+}